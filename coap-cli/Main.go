@@ -14,10 +14,13 @@ limitations under the License.
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/szymex/go-coap-tcp/coap"
+	"log/slog"
 	"net/url"
 	"os"
 	"strings"
@@ -26,9 +29,14 @@ import (
 func main() {
 	//go run ./coap-cli GET coap://localhost:5683/time
 	//go run ./coap-cli GET localhost/time
+	//go run ./coap-cli -ca ca.pem GET coaps+tcp://localhost/time
+	//go run ./coap-cli GET coap+ws://localhost:8080/time
 
 	var contentFormat = flag.Int("cf", -1, "content format:\n  0 - text/plain\n  41 - application/xml\n  42 - application/octet-stream\n  50 - application/json\n")
 	var maxAge = flag.Int("max-age", 60, "max age in seconds")
+	var caFile = flag.String("ca", "", "PEM file with trusted CA certificates (coaps+tcp, coaps+ws)")
+	var insecure = flag.Bool("insecure", false, "skip server certificate verification (coaps+tcp, coaps+ws)")
+	var verbose = flag.Bool("v", false, "log sent and received messages")
 	flag.Parse()
 
 	if flag.NArg() < 2 {
@@ -41,11 +49,30 @@ func main() {
 	uri := parseUri(flag.Arg(1))
 
 	req := coap.NewCoapPacket(method, payload)
-	req.UriPath = uri.Path
-	req.ContentFormat = int16(*contentFormat)
-	req.MaxAge = uint32(*maxAge)
+	//signals, like PING, must not carry request options
+	if method>>5 == 0 {
+		if err := req.SetURL(uri); err != nil {
+			exit(err)
+		}
+		req.SetContentFormat(int16(*contentFormat))
+		req.SetMaxAge(uint32(*maxAge))
+	}
+
+	dialer := coap.Dialer{TLSConfig: tlsConfig(*caFile, *insecure)}
+	if *verbose {
+		dialer.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
 
-	client, err := coap.Connect(uri.Host)
+	var client *coap.CoapClient
+	var err error
+	switch uri.Scheme {
+	case "coaps+tcp":
+		client, err = dialer.DialTLS(uri.Host)
+	case "coap+ws", "coaps+ws":
+		client, err = dialer.DialWebSocket(uri.Scheme + "://" + uri.Host)
+	default:
+		client, err = dialer.Dial(uri.Host)
+	}
 	if err != nil {
 		exit(err)
 	}
@@ -55,8 +82,10 @@ func main() {
 		exit(err)
 	}
 
+	if location := resp.ResolveLocation(uri); method == coap.POST && location != nil {
+		fmt.Println("Location:", location)
+	}
 	if len(resp.Payload) > 0 {
-		fmt.Println("")
 		fmt.Println(string(resp.Payload))
 	}
 }
@@ -67,20 +96,57 @@ func printUsage() {
 	flag.PrintDefaults()
 	fmt.Println("Example:")
 	fmt.Println("  coap-cli GET coap://localhost:5683/time")
+	fmt.Println("  coap-cli GET coap://localhost:5683/sensors?unit=C")
 	fmt.Println("  coap-cli PUT coap://localhost:5683/tmp Lorem ipsum")
+	fmt.Println("  coap-cli -ca ca.pem GET coaps+tcp://localhost:5684/time")
+	fmt.Println("  coap-cli GET coap+ws://localhost:8080/time")
+	fmt.Println("  coap-cli -v PING coap://localhost:5683")
 }
 
 func parseUri(uri string) *url.URL {
+	if !strings.Contains(uri, "://") {
+		uri = "coap://" + uri
+	}
 	u, err := url.Parse(uri)
 	if err != nil {
 		exit(err)
 	}
+	switch u.Scheme {
+	case "coap", "coap+tcp", "coaps+tcp":
+	case "coap+ws", "coaps+ws":
+		//WebSocket port is taken from the uri or the scheme default
+		return u
+	default:
+		exit(errors.New("Unsupported scheme: " + u.Scheme))
+	}
+
 	if u.Port() == "" {
-		u.Host = u.Host + ":5683"
+		if u.Scheme == "coaps+tcp" {
+			u.Host = u.Host + ":5684"
+		} else {
+			u.Host = u.Host + ":5683"
+		}
 	}
 	return u
 }
 
+func tlsConfig(caFile string, insecure bool) *tls.Config {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile == "" {
+		return config
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		exit(err)
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		exit(errors.New("No certificates found in: " + caFile))
+	}
+	return config
+}
+
 func exit(err error) {
 	fmt.Println(err)
 	os.Exit(1)
@@ -0,0 +1,432 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// https://tools.ietf.org/html/rfc7959
+// https://tools.ietf.org/html/rfc8323#section-6
+
+const (
+	//BERT, https://tools.ietf.org/html/rfc8323#section-6
+	SZX_BERT = 7
+
+	//largest body reassembled from Block1 requests
+	MAX_BLOCKWISE_PAYLOAD = 16 * 1024 * 1024
+
+	//Block1 and Block2 transfers in progress on a connection, each kind
+	MAX_BLOCKWISE_TRANSFERS = 16
+
+	//worst case size of block and size options added to a message
+	blockOptionsOverhead = 2*(1+3) + 2*(2+4)
+)
+
+// BLOCKWISE_TRANSFER_TIMEOUT discards transfers not continued by the client, for example
+// cancelled uploads. https://tools.ietf.org/html/rfc7959#section-2.4
+const BLOCKWISE_TRANSFER_TIMEOUT = 2 * time.Minute
+
+// block1Transfer is a request body being reassembled
+type block1Transfer struct {
+	body    *bytes.Buffer
+	expires time.Time
+}
+
+// block2Transfer is a response being sent in blocks
+type block2Transfer struct {
+	resp    *CoapPacket
+	expires time.Time
+}
+
+// Block is a value of Block1 or Block2 option
+type Block struct {
+	Num  uint32
+	More bool
+	SZX  uint8
+}
+
+// unit returns block size, BERT blocks are counted in 1024 bytes units
+func (b Block) unit() int {
+	return blockUnit(b.SZX)
+}
+
+func (b Block) String() string {
+	if b.SZX == SZX_BERT {
+		return fmt.Sprintf("%d/%t/BERT", b.Num, b.More)
+	}
+	return fmt.Sprintf("%d/%t/%d", b.Num, b.More, b.unit())
+}
+
+func blockUnit(szx uint8) int {
+	if szx >= SZX_BERT {
+		return 1024
+	}
+	return 1 << (szx + 4)
+}
+
+func (p *CoapPacket) Block1() (Block, bool) {
+	return p.blockOption(OPT_BLOCK1)
+}
+
+func (p *CoapPacket) SetBlock1(block Block) {
+	p.setBlockOption(OPT_BLOCK1, block)
+}
+
+func (p *CoapPacket) Block2() (Block, bool) {
+	return p.blockOption(OPT_BLOCK2)
+}
+
+func (p *CoapPacket) SetBlock2(block Block) {
+	p.setBlockOption(OPT_BLOCK2, block)
+}
+
+func (p *CoapPacket) blockOption(num uint16) (Block, bool) {
+	val, ok := p.UintOption(num)
+	if !ok {
+		return Block{}, false
+	}
+	return Block{val >> 4, val&0x08 != 0, uint8(val & 0x07)}, true
+}
+
+func (p *CoapPacket) setBlockOption(num uint16, block Block) {
+	val := block.Num<<4 + uint32(block.SZX&0x07)
+	if block.More {
+		val |= 0x08
+	}
+	p.SetUintOption(num, val)
+}
+
+// blockSize returns SZX and payload size of blocks that keep packet within maxSize
+func blockSize(p *CoapPacket, maxSize uint32, bert bool) (uint8, int, error) {
+	empty := withLongestToken(p)
+	empty.Payload = nil
+	frame, err := empty.encode()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	//payload marker and extended length growth
+	budget := int(maxSize) - len(frame) - blockOptionsOverhead - 1 - 3
+	if bert && budget >= 1024 {
+		return SZX_BERT, budget / 1024 * 1024, nil
+	}
+	for szx := uint8(6); budget >= 16; szx-- {
+		if blockUnit(szx) <= budget {
+			return szx, blockUnit(szx), nil
+		}
+	}
+	return 0, 0, &MessageTooLargeError{uint32(len(frame)), maxSize}
+}
+
+// withLongestToken returns a copy of packet with 8 bytes token, sizes of requests are
+// checked before the token is assigned
+func withLongestToken(p *CoapPacket) *CoapPacket {
+	c := p.clone()
+	c.token = make([]byte, 8)
+	return c
+}
+
+func (p *CoapPacket) clone() *CoapPacket {
+	c := *p
+	c.options = append([]Option{}, p.options...)
+	c.observer = nil
+	return &c
+}
+
+// blockKey identifies block-wise transfer of a request by its method and options, except
+// options that differ between blocks. https://tools.ietf.org/html/rfc7959#section-2.4
+// Observe is left out as well, it is not repeated in requests for further blocks.
+// https://tools.ietf.org/html/rfc7959#section-2.6
+func blockKey(req *CoapPacket) string {
+	var key bytes.Buffer
+	key.WriteByte(req.Code)
+	for _, opt := range req.Options() {
+		switch opt.Number {
+		case OPT_BLOCK1, OPT_BLOCK2, OPT_SIZE1, OPT_SIZE2, OPT_OBSERVE:
+			continue
+		}
+		key.Write(binary.BigEndian.AppendUint16(nil, opt.Number))
+		key.Write(binary.BigEndian.AppendUint32(nil, uint32(len(opt.Value))))
+		key.Write(opt.Value)
+	}
+	return key.String()
+}
+
+func fits(p *CoapPacket, maxSize uint32) bool {
+	frame, err := withLongestToken(p).encode()
+	return err == nil && uint32(len(frame)) <= maxSize
+}
+
+//------ client ----------
+
+func (client *CoapClient) isBert() bool {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+
+	return client.csm.BlockWiseTransfer && client.serverCsm.BlockWiseTransfer
+}
+
+func (client *CoapClient) peerMaxMessageSize() uint32 {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+
+	return client.serverCsm.MaxMessageSize
+}
+
+// sendBlock1 sends request, splitting the payload into Block1 requests when it does not fit
+// into peer's Max-Message-Size
+func (client *CoapClient) sendBlock1(ctx context.Context, req *CoapPacket) (*CoapPacket, error) {
+	maxSize := client.peerMaxMessageSize()
+	if fits(req, maxSize) {
+		return client.exchange(ctx, req)
+	}
+
+	szx, size, err := blockSize(req, maxSize, client.isBert())
+	if err != nil {
+		return nil, err
+	}
+
+	payload := req.Payload
+	offset := 0
+	for {
+		end := offset + size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		block := Block{uint32(offset / blockUnit(szx)), end < len(payload), szx}
+
+		blockReq := req.clone()
+		blockReq.Payload = payload[offset:end]
+		blockReq.SetBlock1(block)
+		blockReq.SetUintOption(OPT_SIZE1, uint32(len(payload)))
+
+		resp, err := client.exchange(ctx, blockReq)
+		if err != nil || !block.More || resp.Code != CODE_231_CONTINUE {
+			return resp, err
+		}
+
+		offset = end
+		//server asks for smaller blocks
+		if respBlock, ok := resp.Block1(); ok && respBlock.SZX < szx {
+			szx = respBlock.SZX
+			size = blockUnit(szx)
+		}
+	}
+}
+
+// receiveBlock2 retrieves remaining blocks of a response and returns it with the whole payload
+func (client *CoapClient) receiveBlock2(ctx context.Context, req *CoapPacket, resp *CoapPacket) (*CoapPacket, error) {
+	block, ok := resp.Block2()
+	if !ok {
+		return resp, nil
+	}
+
+	body := append([]byte{}, resp.Payload...)
+	for block.More {
+		if len(body) > MAX_BLOCKWISE_PAYLOAD {
+			return nil, &MessageTooLargeError{uint32(len(body)), MAX_BLOCKWISE_PAYLOAD}
+		}
+
+		next := req.clone()
+		next.Payload = nil
+		next.RemoveOption(OPT_BLOCK1)
+		next.RemoveOption(OPT_SIZE1)
+		next.SetBlock2(Block{uint32(len(body) / block.unit()), false, block.SZX})
+
+		blockResp, err := client.exchange(ctx, next)
+		if err != nil {
+			return nil, err
+		}
+
+		var ok bool
+		block, ok = blockResp.Block2()
+		if !ok || blockResp.Code>>5 != 2 {
+			return blockResp, nil
+		}
+		if int(block.Num)*block.unit() != len(body) {
+			return nil, errors.New("coap: unexpected block " + block.String())
+		}
+		body = append(body, blockResp.Payload...)
+	}
+
+	full := resp.clone()
+	full.Payload = body
+	full.RemoveOption(OPT_BLOCK2)
+	return full, nil
+}
+
+//------ server ----------
+
+func (sc *serverConn) isBert() bool {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	return sc.csm.BlockWiseTransfer && sc.peerCsm.BlockWiseTransfer
+}
+
+func (sc *serverConn) peerMaxMessageSize() uint32 {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	return sc.peerCsm.MaxMessageSize
+}
+
+// assembleBlock1 collects Block1 payloads, it returns either the whole request
+// or a response to send back when more blocks are expected
+func (sc *serverConn) assembleBlock1(req *CoapPacket) (*CoapPacket, *CoapPacket) {
+	block, ok := req.Block1()
+	if !ok {
+		return req, nil
+	}
+
+	key := blockKey(req)
+	now := time.Now()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.expireBlockTransfers(now)
+
+	transfer := sc.block1[key]
+	if block.Num == 0 {
+		transfer = &block1Transfer{body: new(bytes.Buffer)}
+	}
+	if transfer == nil || transfer.body.Len() != int(block.Num)*block.unit() {
+		delete(sc.block1, key)
+		return nil, req.ResponseCode(CODE_408_REQUEST_ENTITY_INCOMPLETE)
+	}
+	if transfer.body.Len()+len(req.Payload) > MAX_BLOCKWISE_PAYLOAD {
+		delete(sc.block1, key)
+		resp := req.ResponseCode(CODE_413_REQUEST_ENTITY_TOO_LARGE)
+		resp.SetUintOption(OPT_SIZE1, MAX_BLOCKWISE_PAYLOAD)
+		return nil, resp
+	}
+
+	if block.More {
+		if _, exists := sc.block1[key]; !exists && len(sc.block1) >= MAX_BLOCKWISE_TRANSFERS {
+			return nil, req.ResponseText(CODE_503_SERVICE_NOT_AVAILABLE, "too many block-wise transfers")
+		}
+		transfer.body.Write(req.Payload)
+		transfer.expires = now.Add(BLOCKWISE_TRANSFER_TIMEOUT)
+		sc.block1[key] = transfer
+		resp := req.ResponseCode(CODE_231_CONTINUE)
+		resp.SetBlock1(block)
+		return nil, resp
+	}
+
+	delete(sc.block1, key)
+	transfer.body.Write(req.Payload)
+	full := req.clone()
+	full.Payload = transfer.body.Bytes()
+	full.RemoveOption(OPT_BLOCK1)
+	full.RemoveOption(OPT_SIZE1)
+	return full, nil
+}
+
+// cachedBlock2 returns next block of a response that was split before
+func (sc *serverConn) cachedBlock2(req *CoapPacket) *CoapPacket {
+	block, ok := req.Block2()
+	if !ok || block.Num == 0 {
+		return nil
+	}
+
+	sc.mu.Lock()
+	sc.expireBlockTransfers(time.Now())
+	transfer, exists := sc.block2[blockKey(req)]
+	sc.mu.Unlock()
+
+	if !exists {
+		return nil
+	}
+	return sc.block2Response(req, transfer.resp)
+}
+
+// expireBlockTransfers discards transfers that timed out, sc.mu must be held
+func (sc *serverConn) expireBlockTransfers(now time.Time) {
+	for key, transfer := range sc.block1 {
+		if now.After(transfer.expires) {
+			delete(sc.block1, key)
+		}
+	}
+	for key, transfer := range sc.block2 {
+		if now.After(transfer.expires) {
+			delete(sc.block2, key)
+		}
+	}
+}
+
+// block2Response returns the block of response requested by the client, or the first one
+// when the response does not fit into peer's Max-Message-Size
+func (sc *serverConn) block2Response(req *CoapPacket, full *CoapPacket) *CoapPacket {
+	requested, hasBlock2 := req.Block2()
+	maxSize := sc.peerMaxMessageSize()
+	if !hasBlock2 && fits(full, maxSize) {
+		return full
+	}
+
+	szx, size, err := blockSize(full, maxSize, sc.isBert())
+	if err != nil {
+		return full
+	}
+	if hasBlock2 && requested.SZX < szx {
+		szx = requested.SZX
+		size = blockUnit(szx)
+	}
+
+	offset := int(requested.Num) * requested.unit()
+	if offset > len(full.Payload) {
+		return req.ResponseCode(CODE_402_BAD_OPTION)
+	}
+	end := offset + size
+	if end > len(full.Payload) {
+		end = len(full.Payload)
+	}
+
+	resp := full.clone()
+	resp.token = req.token
+	resp.Payload = full.Payload[offset:end]
+	resp.SetBlock2(Block{uint32(offset / blockUnit(szx)), end < len(full.Payload), szx})
+	resp.SetUintOption(OPT_SIZE2, uint32(len(full.Payload)))
+
+	key := blockKey(req)
+	sc.mu.Lock()
+	if end < len(full.Payload) {
+		//requests for further blocks of a discarded response are served by the handler again
+		if _, exists := sc.block2[key]; !exists && len(sc.block2) >= MAX_BLOCKWISE_TRANSFERS {
+			sc.discardOldestBlock2()
+		}
+		sc.block2[key] = &block2Transfer{full, time.Now().Add(BLOCKWISE_TRANSFER_TIMEOUT)}
+	} else {
+		delete(sc.block2, key)
+	}
+	sc.mu.Unlock()
+
+	return resp
+}
+
+// discardOldestBlock2 removes the response expiring first, sc.mu must be held
+func (sc *serverConn) discardOldestBlock2() {
+	var oldest string
+	var expires time.Time
+	for key, transfer := range sc.block2 {
+		if expires.IsZero() || transfer.expires.Before(expires) {
+			oldest, expires = key, transfer.expires
+		}
+	}
+	delete(sc.block2, oldest)
+}
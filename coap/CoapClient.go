@@ -14,76 +14,272 @@ limitations under the License.
 package coap
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var ErrClientClosed = errors.New("coap: client connection closed")
+
+// ErrConnectionReleased is returned by requests sent on a connection released by the server
+// that was closed before they were answered
+var ErrConnectionReleased = errors.New("coap: connection released")
+
+// ErrConnectionLost is returned by requests that were not answered when the connection failed
+// and the client reconnects
+var ErrConnectionLost = errors.New("coap: connection lost")
+
+// ErrKeepAliveTimeout closes the client when the server does not answer keep-alive ping in time
+var ErrKeepAliveTimeout = errors.New("coap: keep-alive timeout")
+
+// ALPN protocol id of CoAP over TLS, https://tools.ietf.org/html/rfc8323#section-8.2
+const ALPN_COAP = "coap"
+
+// Dialer connects clients with custom options, zero value uses the defaults
+type Dialer struct {
+	//capabilities sent to the server, default is Max-Message-Size 10000 without block-wise transfer
+	CSM *Capabilities
+	//used by coaps+tcp and coaps+ws
+	TLSConfig *tls.Config
+	//nil disables logging
+	Logger *slog.Logger
+
+	//ping interval when nothing is received from the server, 0 disables keep-alive
+	KeepAlive time.Duration
+	//how long to wait for pong before the connection is considered dead, default is KeepAlive
+	KeepAliveTimeout time.Duration
+
+	//reconnects when the connection is lost, nil closes the client instead
+	Reconnect *ReconnectPolicy
+	//called with every change of connection state, from client goroutines
+	OnStateChange func(state ConnState, err error)
+
+	//serves requests sent by the server, for example a Router, nil responds with 4.04
+	Handler Handler
+}
+
 func Connect(address string) (*CoapClient, error) {
-	return ConnectWithCSM(address, &Capabilities{10000, false})
+	return (&Dialer{}).Dial(address)
 }
 
 func ConnectWithCSM(address string, csm *Capabilities) (*CoapClient, error) {
-	conn, err := net.Dial("tcp", address)
+	return (&Dialer{CSM: csm}).Dial(address)
+}
+
+// ConnectTLS connects to coaps+tcp server, ALPN protocol "coap" is added to the config
+func ConnectTLS(address string, config *tls.Config) (*CoapClient, error) {
+	return (&Dialer{TLSConfig: config}).DialTLS(address)
+}
+
+func ConnectTLSWithCSM(address string, config *tls.Config, csm *Capabilities) (*CoapClient, error) {
+	return (&Dialer{CSM: csm, TLSConfig: config}).DialTLS(address)
+}
+
+// Dial connects to coap+tcp server
+func (d *Dialer) Dial(address string) (*CoapClient, error) {
+	return d.connect(address, func(address string) (packetConn, error) {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return newTcpConn(conn), nil
+	})
+}
+
+// DialTLS connects to coaps+tcp server, ALPN protocol "coap" is added to TLSConfig
+func (d *Dialer) DialTLS(address string) (*CoapClient, error) {
+	config := withAlpn(d.TLSConfig)
+	return d.connect(address, func(address string) (packetConn, error) {
+		conn, err := tls.Dial("tcp", address, config)
+		if err != nil {
+			return nil, err
+		}
+		return newTcpConn(conn), nil
+	})
+}
+
+// connect dials address and creates client that uses dial again when the server releases the connection
+func (d *Dialer) connect(address string, dial func(address string) (packetConn, error)) (*CoapClient, error) {
+	csm := d.CSM
+	if csm == nil {
+		csm = &Capabilities{10000, false}
+	}
+
+	conn, err := dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newClient(conn, csm, loggerOrDiscard(d.Logger))
 	if err != nil {
 		return nil, err
 	}
+	client.address = address
+	client.dial = dial
+	client.policy = d.Reconnect
+	client.onStateChange = d.OnStateChange
+	client.handler = d.Handler
+	go client.readLoop(conn)
 
+	if d.KeepAlive > 0 {
+		timeout := d.KeepAliveTimeout
+		if timeout <= 0 {
+			timeout = d.KeepAlive
+		}
+		go client.keepAlive(d.KeepAlive, timeout)
+	}
+	return client, nil
+}
+
+// withAlpn returns a copy of config that offers "coap" protocol
+func withAlpn(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+
+	for _, proto := range config.NextProtos {
+		if proto == ALPN_COAP {
+			return config
+		}
+	}
+	config.NextProtos = append(config.NextProtos, ALPN_COAP)
+	return config
+}
+
+// newClient exchanges CSM over established connection, readLoop must be started after it
+func newClient(conn packetConn, csm *Capabilities, logger *slog.Logger) (*CoapClient, error) {
 	timeRand := rand.New(rand.NewSource(time.Now().UnixNano()))
-	client := CoapClient{conn, nil, uint32(timeRand.Int31n(0xFFFF))}
+	client := &CoapClient{
+		log:          logger,
+		csm:          csm,
+		lastToken:    uint32(timeRand.Int31n(0xFFFF)),
+		conns:        map[packetConn]struct{}{},
+		pending:      map[string]*pendingExchange{},
+		observations: map[string]*Observation{},
+		closed:       make(chan struct{}),
+	}
+
+	serverCsm, err := client.exchangeCSM(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	client.conn = conn
+	client.serverCsm = serverCsm
+	client.conns[conn] = struct{}{}
+	client.lastReceived.Store(time.Now().UnixNano())
+	client.log.Info("connected", "peer", conn.RemoteAddr().String())
+
+	return client, nil
+}
+
+// exchangeCSM sends client capabilities and returns capabilities of the server
+func (client *CoapClient) exchangeCSM(conn packetConn) (*Capabilities, error) {
+	peer := conn.RemoteAddr().String()
 
-	//send capabilities
 	coapCSM := NewCoapPacket(CODE_701_CSM, []byte{})
 	coapCSM.token = client.nextToken()
-	coapCSM.CSM = csm
+	coapCSM.CSM = client.csm
 
-	err = coapCSM.Write(client.conn)
-	fmt.Printf("    Sent: %v\n", coapCSM)
+	err := conn.writePacket(coapCSM, 0)
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
+	logPacket(client.log, "sent", coapCSM, "peer", peer)
 
-	//read capabilities
-	peerCoap, errr := ReadCoap(client.conn)
-	if errr != nil {
-		conn.Close()
-		return nil, errr
+	peerCoap, err := conn.readPacket(client.csm.MaxMessageSize)
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("Received: %v\n", peerCoap)
+	logPacket(client.log, "received", peerCoap, "peer", peer)
 	if peerCoap.Code != CODE_701_CSM || peerCoap.CSM == nil {
-		conn.Close()
 		return nil, errors.New("expecting csm not received")
 	}
-
-	client.serverCsm = peerCoap.CSM
-
-	return &client, nil
+	return peerCoap.CSM, nil
 }
 
+// Close closes the connection, including the one released by the server and still in use,
+// and stops reconnecting
 func (client *CoapClient) Close() error {
-	return client.conn.Close()
+	client.closeWithError(net.ErrClosed)
+	return nil
 }
 
 type CoapClient struct {
-	conn      net.Conn
-	serverCsm *Capabilities
+	log       *slog.Logger
+	csm       *Capabilities
 	lastToken uint32
+	//unix nanoseconds of the last message from the server, used by keep-alive
+	lastReceived atomic.Int64
+
+	//connection for new requests and its server capabilities
+	writeMu   sync.Mutex
+	conn      packetConn
+	serverCsm *Capabilities
+
+	//used to connect again when the server releases the connection, or when it is lost
+	address       string
+	dial          func(address string) (packetConn, error)
+	policy        *ReconnectPolicy
+	onStateChange func(state ConnState, err error)
+
+	//serves requests from the server
+	handler Handler
+
+	//requests waiting for response and active observations, by token
+	mu           sync.Mutex
+	conns        map[packetConn]struct{}
+	reconnecting chan struct{}
+	pending      map[string]*pendingExchange
+	observations map[string]*Observation
+	closed       chan struct{}
+	err          error
+}
+
+type pendingExchange struct {
+	result chan exchangeResult
+	req    *CoapPacket
+	//connection the request was sent on
+	conn packetConn
+}
+
+type exchangeResult struct {
+	resp *CoapPacket
+	err  error
 }
 
 func (client *CoapClient) Ping() error {
-	coapPing := NewCoapPacket(CODE_702_PING, []byte{})
-	coapPing.token = client.nextToken()
+	return client.PingContext(context.Background())
+}
 
-	err := coapPing.Write(client.conn)
-	if err != nil {
-		return err
+func (client *CoapClient) PingContext(ctx context.Context) error {
+	return client.ping(ctx, false)
+}
+
+// PingWithCustody sends Ping with Custody option, the server answers after responding
+// to all requests it has received before the ping
+// https://tools.ietf.org/html/rfc8323#section-5.4
+func (client *CoapClient) PingWithCustody(ctx context.Context) error {
+	return client.ping(ctx, true)
+}
+
+func (client *CoapClient) ping(ctx context.Context, custody bool) error {
+	coapPing := NewCoapPacket(CODE_702_PING, []byte{})
+	if custody {
+		coapPing.AddOption(OPT_PING_CUSTODY, []byte{})
 	}
 
-	resp, err := ReadCoap(client.conn)
+	resp, err := client.exchange(ctx, coapPing)
 	if err != nil {
 		return err
 	}
@@ -94,51 +290,342 @@ func (client *CoapClient) Ping() error {
 	return nil
 }
 
+// keepAlive pings the server when nothing was received for interval, the connection is
+// closed when pong does not come within timeout
+func (client *CoapClient) keepAlive(interval time.Duration, timeout time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-client.closed:
+			return
+		}
+
+		idle := time.Since(time.Unix(0, client.lastReceived.Load()))
+		if idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+
+		conn, err := client.currentConn(context.Background())
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = client.PingContext(ctx)
+		cancel()
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			client.log.Warn("keep-alive ping not answered", "peer", conn.RemoteAddr().String(), "timeout", timeout)
+			client.connectionLost(conn, ErrKeepAliveTimeout)
+		}
+		timer.Reset(interval)
+	}
+}
+
 func (client *CoapClient) Get(uriPath string) (*CoapPacket, error) {
-	return client.Invoke(GET, uriPath, -1, []byte{})
+	return client.GetContext(context.Background(), uriPath)
 }
 
 func (client *CoapClient) Post(uriPath string, payload string) (*CoapPacket, error) {
-	return client.Invoke(POST, uriPath, MT_TEXT_PLAIN, []byte(payload))
+	return client.PostContext(context.Background(), uriPath, payload)
 }
 
 func (client *CoapClient) Put(uriPath string, payload string) (*CoapPacket, error) {
-	return client.Invoke(PUT, uriPath, MT_TEXT_PLAIN, []byte(payload))
+	return client.PutContext(context.Background(), uriPath, payload)
 }
 
 func (client *CoapClient) Delete(uriPath string) (*CoapPacket, error) {
-	return client.Invoke(DELETE, uriPath, -1, []byte{})
+	return client.DeleteContext(context.Background(), uriPath)
 }
 
 func (client *CoapClient) Invoke(method uint8, uriPath string, contentFormat int16, payload []byte) (*CoapPacket, error) {
+	return client.InvokeContext(context.Background(), method, uriPath, contentFormat, payload)
+}
+
+// InvokeCoap sends a request and waits for the response with the same token.
+// It is safe to call from many goroutines, requests share one connection.
+func (client *CoapClient) InvokeCoap(req *CoapPacket) (*CoapPacket, error) {
+	return client.InvokeCoapContext(context.Background(), req)
+}
+
+func (client *CoapClient) GetContext(ctx context.Context, uriPath string) (*CoapPacket, error) {
+	return client.InvokeContext(ctx, GET, uriPath, -1, []byte{})
+}
+
+func (client *CoapClient) PostContext(ctx context.Context, uriPath string, payload string) (*CoapPacket, error) {
+	return client.InvokeContext(ctx, POST, uriPath, MT_TEXT_PLAIN, []byte(payload))
+}
+
+func (client *CoapClient) PutContext(ctx context.Context, uriPath string, payload string) (*CoapPacket, error) {
+	return client.InvokeContext(ctx, PUT, uriPath, MT_TEXT_PLAIN, []byte(payload))
+}
+
+func (client *CoapClient) DeleteContext(ctx context.Context, uriPath string) (*CoapPacket, error) {
+	return client.InvokeContext(ctx, DELETE, uriPath, -1, []byte{})
+}
+
+func (client *CoapClient) InvokeContext(ctx context.Context, method uint8, uriPath string, contentFormat int16, payload []byte) (*CoapPacket, error) {
 	req := NewCoapPacket(method, payload)
-	req.token = client.nextToken()
-	req.UriPath = uriPath
-	req.ContentFormat = contentFormat
+	req.SetUriPath(uriPath)
+	req.SetContentFormat(contentFormat)
 
-	return client.InvokeCoap(req)
+	return client.InvokeCoapContext(ctx, req)
 }
 
-func (client *CoapClient) InvokeCoap(req *CoapPacket) (*CoapPacket, error) {
+// InvokeCoapContext is like InvokeCoap but gives up waiting when ctx is done.
+// The connection stays open, a response arriving later is dropped.
+func (client *CoapClient) InvokeCoapContext(ctx context.Context, req *CoapPacket) (*CoapPacket, error) {
+	//lets the server tell apart concurrent block-wise transfers of the same request
+	if !fits(req, client.peerMaxMessageSize()) && !req.HasOption(OPT_REQUEST_TAG) {
+		req = req.clone()
+		req.SetOption(OPT_REQUEST_TAG, client.nextToken())
+	}
+
+	resp, err := client.sendBlock1(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return client.receiveBlock2(ctx, req, resp)
+}
+
+func (client *CoapClient) exchange(ctx context.Context, req *CoapPacket) (*CoapPacket, error) {
 	req.token = client.nextToken()
-	err := req.Write(client.conn)
+	return client.send(ctx, req)
+}
+
+// send writes request with already assigned token and waits for the response
+func (client *CoapClient) send(ctx context.Context, req *CoapPacket) (*CoapPacket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := client.currentConn(ctx)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("    Sent: %v\n", req)
 
-	//todo: verify token
-	resp, err := ReadCoap(client.conn)
-	if resp != nil {
-		fmt.Printf("Received: %v\n", resp)
+	key := string(req.token)
+	exchange := &pendingExchange{make(chan exchangeResult, 1), req, conn}
+	client.mu.Lock()
+	if client.err != nil {
+		client.mu.Unlock()
+		return nil, client.err
 	}
+	client.pending[key] = exchange
+	client.mu.Unlock()
 
-	return resp, err
+	defer func() {
+		client.mu.Lock()
+		delete(client.pending, key)
+		client.mu.Unlock()
+	}()
+
+	err = client.writeTo(conn, req)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case result := <-exchange.result:
+		return result.resp, result.err
+	case <-client.closed:
+		return nil, client.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
-func (client *CoapClient) nextToken() []byte {
-	token := client.lastToken + 1
-	client.lastToken++
+// currentConn returns connection for new requests, it waits while the client reconnects
+func (client *CoapClient) currentConn(ctx context.Context) (packetConn, error) {
+	for {
+		client.mu.Lock()
+		reconnecting, err := client.reconnecting, client.err
+		client.mu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+		if reconnecting == nil {
+			client.writeMu.Lock()
+			defer client.writeMu.Unlock()
+			return client.conn, nil
+		}
+
+		select {
+		case <-reconnecting:
+		case <-client.closed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
 
-	return writeDynamicUint32(token)
+func (client *CoapClient) write(packet *CoapPacket) error {
+	conn, err := client.currentConn(context.Background())
+	if err != nil {
+		return err
+	}
+	return client.writeTo(conn, packet)
+}
+
+func (client *CoapClient) writeTo(conn packetConn, packet *CoapPacket) error {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+
+	err := conn.writePacket(packet, client.serverCsm.MaxMessageSize)
+	if err == nil {
+		logPacket(client.log, "sent", packet, "peer", conn.RemoteAddr().String())
+	}
+	return err
+}
+
+// readLoop routes every received message to the request waiting for its token,
+// until the connection fails
+func (client *CoapClient) readLoop(conn packetConn) {
+	peer := conn.RemoteAddr().String()
+	for {
+		resp, err := conn.readPacket(client.csm.MaxMessageSize)
+
+		var tooLarge *MessageTooLargeError
+		if err != nil && !errors.As(err, &tooLarge) {
+			client.writeMu.Lock()
+			abortOnProtocolError(conn, err, client.log.With("peer", peer))
+			client.writeMu.Unlock()
+
+			client.connectionLost(conn, err)
+			return
+		}
+		client.lastReceived.Store(time.Now().UnixNano())
+		logPacket(client.log, "received", resp, "peer", peer)
+
+		switch resp.Code {
+		case CODE_701_CSM:
+			client.writeMu.Lock()
+			if client.conn == conn {
+				client.serverCsm = resp.CSM
+			}
+			client.writeMu.Unlock()
+			continue
+		case CODE_702_PING:
+			//https://tools.ietf.org/html/rfc8323#section-5.4, custody is echoed without waiting for requests served by Dialer.Handler
+			pong := resp.ResponseCode(CODE_703_PONG)
+			if resp.HasOption(OPT_PING_CUSTODY) {
+				pong.AddOption(OPT_PING_CUSTODY, []byte{})
+			}
+			if err := client.writeTo(conn, pong); err != nil {
+				client.log.Warn("pong not sent", "err", err)
+			}
+			continue
+		case CODE_704_RELEASE:
+			//marked before reading on, the server closes released connection soon
+			client.released(conn, resp)
+			continue
+		case CODE_705_ABORT:
+			badOption, _ := resp.BadCSMOption()
+			client.connectionLost(conn, &AbortError{string(resp.Payload), badOption})
+			return
+		}
+
+		if isRequest(resp.Code) && err == nil {
+			go client.serve(conn, resp)
+			continue
+		}
+
+		client.mu.Lock()
+		obs, observed := client.observations[string(resp.token)]
+		exchange, exists := client.pending[string(resp.token)]
+		client.mu.Unlock()
+
+		if observed && err == nil {
+			obs.deliver(resp)
+			if !isNotification(resp) {
+				client.removeObservation(obs)
+			}
+		} else if exists {
+			select {
+			case exchange.result <- exchangeResult{resp, err}:
+			default:
+			}
+		}
+	}
+}
+
+// connectionLost fails requests sent on conn, or replays them when allowed by ReconnectPolicy.
+// When conn is the current connection, the client reconnects or closes without a ReconnectPolicy.
+func (client *CoapClient) connectionLost(conn packetConn, err error) {
+	client.mu.Lock()
+	delete(client.conns, conn)
+	current := client.conn == conn && client.reconnecting == nil
+	if current && (client.policy == nil || client.err != nil) {
+		client.mu.Unlock()
+		client.closeWithError(err)
+		return
+	}
+
+	var ready chan struct{}
+	if current {
+		ready = make(chan struct{})
+		client.reconnecting = ready
+	}
+	address := client.address
+	lost := map[string]*pendingExchange{}
+	for key, exchange := range client.pending {
+		if exchange.conn == conn {
+			lost[key] = exchange
+		}
+	}
+	client.mu.Unlock()
+
+	conn.Close()
+	client.log.Info("disconnected", "peer", conn.RemoteAddr().String(), "err", err)
+
+	lostErr := fmt.Errorf("%w: %w", ErrConnectionReleased, err)
+	if current {
+		lostErr = fmt.Errorf("%w: %w", ErrConnectionLost, err)
+		client.stateChanged(STATE_RECONNECTING, err)
+		go client.reconnect(ready, address, client.policy.backoff(0))
+	}
+
+	for key, exchange := range lost {
+		if client.policy != nil && client.policy.ReplayIdempotent && isIdempotent(exchange.req.Code) {
+			go client.replay(key, exchange)
+			continue
+		}
+		select {
+		case exchange.result <- exchangeResult{nil, lostErr}:
+		default:
+		}
+	}
+}
+
+func (client *CoapClient) closeWithError(err error) {
+	client.mu.Lock()
+	if client.err != nil {
+		client.mu.Unlock()
+		return
+	}
+	client.err = fmt.Errorf("%w: %w", ErrClientClosed, err)
+	observations := client.observations
+	client.observations = map[string]*Observation{}
+	conns := client.conns
+	client.conns = map[packetConn]struct{}{}
+	client.mu.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+	client.log.Info("disconnected", "err", err)
+
+	close(client.closed)
+	for _, obs := range observations {
+		obs.end()
+	}
+	client.stateChanged(STATE_CLOSED, err)
+}
+
+func (client *CoapClient) nextToken() []byte {
+	return writeDynamicUint32(atomic.AddUint32(&client.lastToken, 1))
 }
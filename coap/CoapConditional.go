@@ -0,0 +1,177 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+)
+
+// Conditional requests and revalidation with entity tags
+// https://tools.ietf.org/html/rfc7252#section-5.10.6
+// https://tools.ietf.org/html/rfc7252#section-5.10.8
+
+// ETag returns entity tag of a response
+func (p *CoapPacket) ETag() ([]byte, bool) {
+	return p.OpaqueOption(OPT_ETAG)
+}
+
+// SetETag sets entity tag of a response, it removes the option when etag is empty
+func (p *CoapPacket) SetETag(etag []byte) {
+	if len(etag) == 0 {
+		p.RemoveOption(OPT_ETAG)
+		return
+	}
+	p.SetOption(OPT_ETAG, etag)
+}
+
+// ETags returns entity tags of a GET request, of representations the client already has
+func (p *CoapPacket) ETags() [][]byte {
+	return p.OpaqueOptions(OPT_ETAG)
+}
+
+func (p *CoapPacket) AddETag(etag []byte) {
+	p.AddOption(OPT_ETAG, etag)
+}
+
+// IfMatch returns entity tags of If-Match options, an empty one matches any existing representation
+func (p *CoapPacket) IfMatch() [][]byte {
+	return p.OpaqueOptions(OPT_IF_MATCH)
+}
+
+func (p *CoapPacket) AddIfMatch(etag []byte) {
+	p.AddOption(OPT_IF_MATCH, etag)
+}
+
+// IfNoneMatch makes the request conditional on the resource not existing
+func (p *CoapPacket) IfNoneMatch() bool {
+	return p.HasOption(OPT_IF_NONE_MATCH)
+}
+
+func (p *CoapPacket) SetIfNoneMatch(ifNoneMatch bool) {
+	if ifNoneMatch {
+		p.SetOption(OPT_IF_NONE_MATCH, []byte{})
+	} else {
+		p.RemoveOption(OPT_IF_NONE_MATCH)
+	}
+}
+
+// CheckPreconditions evaluates If-Match and If-None-Match of the request against current
+// state of the resource. It returns 4.12 response when the request must not be performed,
+// otherwise nil. Handlers wrapped with Conditional get it evaluated automatically, others call it:
+//
+//	if resp := req.CheckPreconditions(resource.etag, resource.exists); resp != nil {
+//		return resp
+//	}
+func (p *CoapPacket) CheckPreconditions(etag []byte, exists bool) *CoapPacket {
+	if p.IfNoneMatch() && exists {
+		return p.ResponseCode(CODE_412_PRECONDITION_FAILED)
+	}
+
+	ifMatch := p.IfMatch()
+	if len(ifMatch) == 0 {
+		return nil
+	}
+	for _, tag := range ifMatch {
+		if exists && (len(tag) == 0 || bytes.Equal(tag, etag)) {
+			return nil
+		}
+	}
+	return p.ResponseCode(CODE_412_PRECONDITION_FAILED)
+}
+
+// Conditional evaluates If-Match and If-None-Match of requests before handler runs, requests
+// that must not be performed get 4.12. state returns current entity tag of the resource and
+// whether it exists. state and handler are called with lock held, the resource does not change
+// between the check and the handler when all its changes are made under the same lock, also by
+// handlers of other methods or routes. They must not take the lock themselves. Lock may be nil
+// when handler synchronizes by other means, then the check and the handler are not atomic.
+// If-Match and If-None-Match are declared supported, requests with them to handlers without
+// Conditional get 4.02.
+func Conditional(handler Handler, lock sync.Locker, state func(req *CoapPacket) (etag []byte, exists bool)) Handler {
+	return conditionalHandler{handler, lock, state}
+}
+
+type conditionalHandler struct {
+	handler Handler
+	lock    sync.Locker
+	state   func(req *CoapPacket) ([]byte, bool)
+}
+
+func (h conditionalHandler) Serve(peerIP net.Addr, req *CoapPacket) *CoapPacket {
+	if h.lock != nil {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+	}
+
+	if req.IfNoneMatch() || len(req.IfMatch()) > 0 {
+		etag, exists := h.state(req)
+		if resp := req.CheckPreconditions(etag, exists); resp != nil {
+			return resp
+		}
+	}
+	return h.handler.Serve(peerIP, req)
+}
+
+func (h conditionalHandler) SupportedOptions() []uint16 {
+	return append([]uint16{OPT_IF_MATCH, OPT_IF_NONE_MATCH}, supportedOptions(h.handler)...)
+}
+
+// notModified replaces 2.05 response to GET with 2.03 without payload when its ETag
+// is one of the request ETags
+func notModified(req *CoapPacket, resp *CoapPacket) *CoapPacket {
+	etag, ok := resp.ETag()
+	if req.Code != GET || resp.Code != CODE_205_CONTENT || !ok {
+		return resp
+	}
+
+	for _, tag := range req.ETags() {
+		if bytes.Equal(tag, etag) {
+			valid := resp.clone()
+			valid.Code = CODE_203_VALID
+			valid.Payload = []byte{}
+			valid.RemoveOption(OPT_CONTENT_FORMAT)
+			return valid
+		}
+	}
+	return resp
+}
+
+//------ client ----------
+
+// Revalidate requests uriPath with ETag of cached response. When the server answers 2.03,
+// it returns the cached representation with Max-Age of the new response, otherwise
+// the new response.
+func (client *CoapClient) Revalidate(ctx context.Context, uriPath string, cached *CoapPacket) (*CoapPacket, error) {
+	req := NewCoapPacket(GET, []byte{})
+	req.SetUriPath(uriPath)
+	if etag, ok := cached.ETag(); ok {
+		req.AddETag(etag)
+	}
+
+	resp, err := client.InvokeCoapContext(ctx, req)
+	if err != nil || resp.Code != CODE_203_VALID {
+		return resp, err
+	}
+
+	valid := cached.clone()
+	valid.token = resp.token
+	valid.SetMaxAge(resp.MaxAge())
+	if etag, ok := resp.ETag(); ok {
+		valid.SetETag(etag)
+	}
+	return valid, nil
+}
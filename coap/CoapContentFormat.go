@@ -0,0 +1,90 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"net"
+)
+
+// Content negotiation with Accept option, https://tools.ietf.org/html/rfc7252#section-5.10.4
+
+// ContentFormats serves a resource in several content formats, the handler is chosen by
+// Accept option of the request. Requests without Accept get the format added first,
+// requests accepting a format that is not registered get 4.06.
+type ContentFormats struct {
+	formats  []int16
+	handlers map[int16]Handler
+}
+
+func NewContentFormats() *ContentFormats {
+	return &ContentFormats{handlers: map[int16]Handler{}}
+}
+
+// Handle registers handler of contentFormat, it replaces the previous one
+func (c *ContentFormats) Handle(contentFormat int16, handler Handler) *ContentFormats {
+	if _, exists := c.handlers[contentFormat]; !exists {
+		c.formats = append(c.formats, contentFormat)
+	}
+	c.handlers[contentFormat] = handler
+	return c
+}
+
+func (c *ContentFormats) HandleFunc(contentFormat int16, handler func(request *CoapPacket) *CoapPacket) *ContentFormats {
+	return c.Handle(contentFormat, HandlerFunc(handler))
+}
+
+// Serve calls handler of the accepted content format, Content-Format of its 2.xx response
+// with payload is set when the handler did not set it
+func (c *ContentFormats) Serve(peerIP net.Addr, req *CoapPacket) *CoapPacket {
+	if len(c.formats) == 0 {
+		return req.ResponseCode(CODE_404_NOT_FOUND)
+	}
+
+	contentFormat := req.Accept()
+	if contentFormat < 0 {
+		contentFormat = c.formats[0]
+	}
+	handler, ok := c.handlers[contentFormat]
+	if !ok {
+		return req.ResponseCode(CODE_406_NOT_ACCEPTABLE)
+	}
+
+	resp := handler.Serve(peerIP, req)
+	if resp != nil && resp.Code>>5 == 2 && len(resp.Payload) > 0 && resp.ContentFormat() < 0 {
+		resp.SetContentFormat(contentFormat)
+	}
+	return resp
+}
+
+// SupportedOptions returns critical options understood by handlers of all content formats
+func (c *ContentFormats) SupportedOptions() []uint16 {
+	var supported []uint16
+	for _, format := range c.formats {
+		supported = append(supported, supportedOptions(c.handlers[format])...)
+	}
+	return supported
+}
+
+// notAcceptable replaces 2.05 response in other content format than the request accepts with 4.06
+func notAcceptable(req *CoapPacket, resp *CoapPacket) *CoapPacket {
+	accept := req.Accept()
+	if resp == nil || accept < 0 || resp.Code != CODE_205_CONTENT {
+		return resp
+	}
+
+	if contentFormat := resp.ContentFormat(); contentFormat >= 0 && contentFormat != accept {
+		return req.ResponseCode(CODE_406_NOT_ACCEPTABLE)
+	}
+	return resp
+}
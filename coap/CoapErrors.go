@@ -0,0 +1,116 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"fmt"
+)
+
+// Errors returned by ReadCoap when a peer sends a message that can not be processed.
+// They can be inspected with errors.As, every one of them is a protocol violation
+// that should be answered with an Abort signal (7.05).
+
+// MessageFormatError reports a malformed message header, for example a reserved token length.
+type MessageFormatError struct {
+	Reason string
+}
+
+func (e *MessageFormatError) Error() string {
+	return "coap: message format error: " + e.Reason
+}
+
+// TruncatedFrameError reports a frame that ends in the middle of an option.
+type TruncatedFrameError struct {
+	Needed uint32
+	Size   uint32
+}
+
+func (e *TruncatedFrameError) Error() string {
+	return fmt.Sprintf("coap: truncated frame, needed %d bytes of %d", e.Needed, e.Size)
+}
+
+// BadOptionError reports an option that can not be decoded, for example a wrong length.
+type BadOptionError struct {
+	Number uint16
+	Reason string
+}
+
+func (e *BadOptionError) Error() string {
+	return fmt.Sprintf("coap: bad option %d: %s", e.Number, e.Reason)
+}
+
+// UnknownCriticalOptionError reports a critical option in a signaling message
+// that is not defined for its code.
+type UnknownCriticalOptionError struct {
+	Code   uint8
+	Number uint16
+}
+
+func (e *UnknownCriticalOptionError) Error() string {
+	return fmt.Sprintf("coap: unknown critical option %d in %d.%02d", e.Number, e.Code>>5, e.Code&0x1F)
+}
+
+// MessageTooLargeError reports a message exceeding Max-Message-Size,
+// either received from a peer or refused to be sent to it.
+type MessageTooLargeError struct {
+	Size    uint32
+	MaxSize uint32
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("coap: message size %d exceeds max message size %d", e.Size, e.MaxSize)
+}
+
+// AbortError reports an Abort signal received from the peer, the connection is closed after it.
+type AbortError struct {
+	Diagnostic string
+	//set when the peer did not accept an option of CSM
+	BadCSMOption uint16
+}
+
+func (e *AbortError) Error() string {
+	if e.BadCSMOption != 0 {
+		return fmt.Sprintf("coap: aborted by peer: %s (bad csm option %d)", e.Diagnostic, e.BadCSMOption)
+	}
+	return "coap: aborted by peer: " + e.Diagnostic
+}
+
+type protocolError interface {
+	error
+	abort() *CoapPacket
+}
+
+func (e *MessageFormatError) abort() *CoapPacket {
+	return NewAbort(e.Error())
+}
+
+func (e *TruncatedFrameError) abort() *CoapPacket {
+	return NewAbort(e.Error())
+}
+
+func (e *BadOptionError) abort() *CoapPacket {
+	return NewAbort(e.Error())
+}
+
+func (e *MessageTooLargeError) abort() *CoapPacket {
+	return NewAbort(e.Error())
+}
+
+func (e *UnknownCriticalOptionError) abort() *CoapPacket {
+	abort := NewAbort(e.Error())
+	if e.Code == CODE_701_CSM {
+		abort.SetUintOption(OPT_ABORT_BAD_CSM_OPTION, uint32(e.Number))
+	}
+	return abort
+}
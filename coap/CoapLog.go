@@ -0,0 +1,48 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Client and server log with log/slog, they are silent unless a logger is set.
+// Sent and received messages are logged at debug level with code and token attributes,
+// connection events at info level and failures at warn or error level.
+
+// discardHandler drops all records, it is used when no logger is set
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+func loggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.New(discardHandler{})
+	}
+	return logger
+}
+
+// logPacket logs a sent or received message at debug level, with additional attributes args
+func logPacket(logger *slog.Logger, msg string, p *CoapPacket, args ...any) {
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	args = append(args, "code", p.StringCode(), "token", fmt.Sprintf("%x", p.token), "packet", p.String())
+	logger.Debug(msg, args...)
+}
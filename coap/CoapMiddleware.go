@@ -0,0 +1,88 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a handler, for example to log, authenticate or modify requests and responses.
+type Middleware func(next Handler) Handler
+
+// chain wraps handler so that the first middleware runs first
+func chain(middlewares []Middleware, handler Handler) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// peerHandlerFunc is like HandlerFunc but receives peer address
+type peerHandlerFunc func(peerIP net.Addr, req *CoapPacket) *CoapPacket
+
+func (f peerHandlerFunc) Serve(peerIP net.Addr, req *CoapPacket) *CoapPacket {
+	return f(peerIP, req)
+}
+
+// Recovery responds with 5.00 when a handler panics, instead of crashing the server.
+// The panic is logged with logger of the request Session, set with CoapServer.SetLogger.
+// Requests without Session, served by Dialer.Handler, are logged with slog.Default.
+func Recovery(next Handler) Handler {
+	return recovery(nil, next)
+}
+
+// RecoveryWithLogger is like Recovery, but logs panics with logger
+func RecoveryWithLogger(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return recovery(logger, next)
+	}
+}
+
+func recovery(logger *slog.Logger, next Handler) Handler {
+	return peerHandlerFunc(func(peerIP net.Addr, req *CoapPacket) (resp *CoapPacket) {
+		defer func() {
+			if r := recover(); r != nil {
+				log := logger
+				if log == nil && req.Session() != nil {
+					log = req.Session().Logger()
+				}
+				if log == nil {
+					log = slog.Default().With("peer", fmt.Sprint(peerIP))
+				}
+				log.Error("handler panic", "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+				resp = req.ResponseCode(CODE_500_INTERNAL_SERVER_ERROR)
+			}
+		}()
+
+		return next.Serve(peerIP, req)
+	})
+}
+
+// Timing calls report with every request, its response and the time spent in the wrapped handler.
+// Response is nil when the handler did not respond.
+func Timing(report func(req *CoapPacket, resp *CoapPacket, duration time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return peerHandlerFunc(func(peerIP net.Addr, req *CoapPacket) *CoapPacket {
+			start := time.Now()
+			resp := next.Serve(peerIP, req)
+			report(req, resp, time.Since(start))
+
+			return resp
+		})
+	}
+}
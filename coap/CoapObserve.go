@@ -0,0 +1,301 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// https://tools.ietf.org/html/rfc7641
+// https://tools.ietf.org/html/rfc8323#section-7
+
+const (
+	OBSERVE_REGISTER   = 0
+	OBSERVE_DEREGISTER = 1
+)
+
+var ErrObservationEnded = errors.New("coap: observation ended")
+
+//------ server ----------
+
+// Observer is a client registration to a resource. It is created for every GET
+// request with Observe option set to 0 and becomes active once the handler
+// accepts it with AcceptObserve and returns a 2.xx response.
+type Observer struct {
+	conn     *serverConn
+	request  *CoapPacket
+	seq      uint32
+	accepted bool
+
+	ready   chan struct{}
+	done    chan struct{}
+	endOnce sync.Once
+}
+
+// AcceptObserve accepts Observe registration, it returns nil when the request is not a registration.
+func (p *CoapPacket) AcceptObserve() *Observer {
+	if p.observer == nil {
+		return nil
+	}
+	p.observer.accepted = true
+	return p.observer
+}
+
+// Request returns the registration request.
+func (o *Observer) Request() *CoapPacket {
+	return o.request
+}
+
+// Done is closed when the observation ends: client deregistered, connection was closed
+// or non 2.xx notification was sent.
+func (o *Observer) Done() <-chan struct{} {
+	return o.done
+}
+
+// Notify sends a notification to the observer, it waits until the registration response is sent.
+// Notification with code other than 2.xx ends the observation.
+func (o *Observer) Notify(notification *CoapPacket) error {
+	select {
+	case <-o.ready:
+	case <-o.done:
+	}
+	select {
+	case <-o.done:
+		return ErrObservationEnded
+	default:
+	}
+
+	notification.token = o.request.token
+	success := notification.Code>>5 == 2
+	if success {
+		notification.SetUintOption(OPT_OBSERVE, o.nextSeq())
+	} else {
+		notification.RemoveOption(OPT_OBSERVE)
+		o.conn.removeObserver(o)
+	}
+
+	return o.conn.write(notification)
+}
+
+func (o *Observer) nextSeq() uint32 {
+	return atomic.AddUint32(&o.seq, 1) & 0xFFFFFF
+}
+
+func (o *Observer) end() {
+	o.endOnce.Do(func() {
+		close(o.done)
+	})
+}
+
+func (sc *serverConn) prepareObserve(req *CoapPacket) {
+	observe, ok := req.UintOption(OPT_OBSERVE)
+	if req.Code != GET || !ok {
+		return
+	}
+
+	switch observe {
+	case OBSERVE_REGISTER:
+		req.observer = &Observer{conn: sc, request: req, ready: make(chan struct{}), done: make(chan struct{})}
+	case OBSERVE_DEREGISTER:
+		sc.mu.Lock()
+		obs, exists := sc.observers[string(req.token)]
+		sc.mu.Unlock()
+
+		if exists {
+			sc.removeObserver(obs)
+		}
+	}
+}
+
+func (sc *serverConn) registerObserver(req *CoapPacket, resp *CoapPacket) {
+	obs := req.observer
+	if obs == nil {
+		return
+	}
+	if !obs.accepted || resp == nil || resp.Code>>5 != 2 {
+		obs.end()
+		return
+	}
+
+	sc.mu.Lock()
+	previous, exists := sc.observers[string(req.token)]
+	sc.observers[string(req.token)] = obs
+	sc.mu.Unlock()
+
+	if exists {
+		previous.end()
+	}
+	resp.SetUintOption(OPT_OBSERVE, obs.nextSeq())
+}
+
+func (sc *serverConn) removeObserver(obs *Observer) {
+	sc.mu.Lock()
+	if sc.observers[string(obs.request.token)] == obs {
+		delete(sc.observers, string(obs.request.token))
+	}
+	sc.mu.Unlock()
+
+	obs.end()
+}
+
+func (sc *serverConn) removeObservers() {
+	sc.mu.Lock()
+	observers := sc.observers
+	sc.observers = map[string]*Observer{}
+	sc.mu.Unlock()
+
+	for _, obs := range observers {
+		obs.end()
+	}
+}
+
+//------ client ----------
+
+// Observation is a client side registration created with CoapClient.Observe.
+type Observation struct {
+	client        *CoapClient
+	token         []byte
+	uriPath       string
+	notifications chan *CoapPacket
+	established   chan struct{}
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// Observe registers for notifications of a resource and waits for the first response.
+// All responses, starting with the first one, are delivered on Notifications channel,
+// the channel is closed when the observation ends. When the server does not accept
+// the registration, the channel delivers only the first response.
+func (client *CoapClient) Observe(ctx context.Context, uriPath string) (*Observation, error) {
+	obs := &Observation{
+		client:        client,
+		token:         client.nextToken(),
+		uriPath:       uriPath,
+		notifications: make(chan *CoapPacket, 16),
+		established:   make(chan struct{}),
+	}
+	req := obs.registration()
+
+	client.mu.Lock()
+	if client.err != nil {
+		client.mu.Unlock()
+		return nil, client.err
+	}
+	client.observations[string(obs.token)] = obs
+	client.mu.Unlock()
+
+	err := client.write(req)
+	if err != nil {
+		client.removeObservation(obs)
+		return nil, err
+	}
+
+	select {
+	case <-obs.established:
+		return obs, nil
+	case <-client.closed:
+		return nil, client.err
+	case <-ctx.Done():
+		client.removeObservation(obs)
+		client.write(obs.deregistration())
+		return nil, ctx.Err()
+	}
+}
+
+// Notifications delivers responses of the observed resource. When the receiver
+// is slower than the server, the oldest not received notifications are dropped.
+func (o *Observation) Notifications() <-chan *CoapPacket {
+	return o.notifications
+}
+
+// Cancel deregisters from the server and closes Notifications channel.
+func (o *Observation) Cancel(ctx context.Context) error {
+	o.client.removeObservation(o)
+
+	_, err := o.client.send(ctx, o.deregistration())
+	return err
+}
+
+func (o *Observation) registration() *CoapPacket {
+	req := NewCoapPacket(GET, []byte{})
+	req.SetUriPath(o.uriPath)
+	req.SetUintOption(OPT_OBSERVE, OBSERVE_REGISTER)
+	req.token = o.token
+
+	return req
+}
+
+func (o *Observation) deregistration() *CoapPacket {
+	req := NewCoapPacket(GET, []byte{})
+	req.SetUriPath(o.uriPath)
+	req.SetUintOption(OPT_OBSERVE, OBSERVE_DEREGISTER)
+	req.token = o.token
+
+	return req
+}
+
+// deliver is called only from the client read loop
+func (o *Observation) deliver(notification *CoapPacket) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.ended {
+		return
+	}
+
+	for {
+		select {
+		case o.notifications <- notification:
+			select {
+			case <-o.established:
+			default:
+				close(o.established)
+			}
+			return
+		default:
+			//drop oldest
+			select {
+			case <-o.notifications:
+			default:
+			}
+		}
+	}
+}
+
+func (o *Observation) end() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.ended {
+		o.ended = true
+		close(o.notifications)
+	}
+}
+
+func (client *CoapClient) removeObservation(obs *Observation) {
+	client.mu.Lock()
+	if client.observations[string(obs.token)] == obs {
+		delete(client.observations, string(obs.token))
+	}
+	client.mu.Unlock()
+
+	obs.end()
+}
+
+func isNotification(resp *CoapPacket) bool {
+	return resp.Code>>5 == 2 && resp.HasOption(OPT_OBSERVE)
+}
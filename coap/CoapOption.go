@@ -0,0 +1,300 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"sort"
+	"strings"
+)
+
+// https://tools.ietf.org/html/rfc7252#section-5.4
+// https://tools.ietf.org/html/rfc8323#section-5.3
+
+const (
+	//https://tools.ietf.org/html/rfc7252#section-12.2
+	OPT_IF_MATCH       = 1
+	OPT_URI_HOST       = 3
+	OPT_ETAG           = 4
+	OPT_IF_NONE_MATCH  = 5
+	OPT_OBSERVE        = 6
+	OPT_URI_PORT       = 7
+	OPT_LOCATION_PATH  = 8
+	OPT_URI_PATH       = 11
+	OPT_CONTENT_FORMAT = 12
+	OPT_MAX_AGE        = 14
+	OPT_URI_QUERY      = 15
+	OPT_ACCEPT         = 17
+	OPT_LOCATION_QUERY = 20
+	OPT_BLOCK2         = 23
+	OPT_BLOCK1         = 27
+	OPT_SIZE2          = 28
+	OPT_SIZE1          = 60
+
+	//https://tools.ietf.org/html/rfc9175#section-3
+	OPT_REQUEST_TAG = 292
+
+	//signaling options, https://tools.ietf.org/html/rfc8323#section-11.2
+	OPT_CSM_MAX_MESSAGE_SIZE        = 2
+	OPT_CSM_BLOCK_WISE_TRANSFER     = 4
+	OPT_PING_CUSTODY                = 2
+	OPT_RELEASE_ALTERNATIVE_ADDRESS = 2
+	OPT_RELEASE_HOLD_OFF            = 4
+	OPT_ABORT_BAD_CSM_OPTION        = 2
+
+	DEFAULT_MAX_AGE = 60
+
+	//largest value that fits in a 2 byte extended option length
+	MAX_OPTION_LENGTH = 65535 + 269
+)
+
+// options of requests and responses processed by this library, a request with other
+// critical option is rejected with 4.02 unless a handler declares it supported.
+// If-Match and If-None-Match are declared by Conditional.
+var knownOptions = map[uint16]bool{
+	OPT_URI_HOST: true, OPT_URI_PORT: true,
+	OPT_ETAG: true, OPT_OBSERVE: true, OPT_LOCATION_PATH: true, OPT_URI_PATH: true,
+	OPT_CONTENT_FORMAT: true, OPT_MAX_AGE: true, OPT_URI_QUERY: true, OPT_ACCEPT: true,
+	OPT_LOCATION_QUERY: true, OPT_BLOCK2: true, OPT_BLOCK1: true, OPT_SIZE2: true, OPT_SIZE1: true,
+}
+
+// IsCritical reports whether an option must be understood by the receiver, odd option
+// numbers are critical. https://tools.ietf.org/html/rfc7252#section-5.4.1
+func IsCritical(number uint16) bool {
+	return number&1 == 1
+}
+
+// UnrecognizedOptions returns critical options of a request or response that are neither
+// processed by this library nor listed in supported, each number once
+func (p *CoapPacket) UnrecognizedOptions(supported ...uint16) []uint16 {
+	var unrecognized []uint16
+	for _, opt := range p.Options() {
+		if !IsCritical(opt.Number) || knownOptions[opt.Number] || containsOption(supported, opt.Number) {
+			continue
+		}
+		if len(unrecognized) == 0 || unrecognized[len(unrecognized)-1] != opt.Number {
+			unrecognized = append(unrecognized, opt.Number)
+		}
+	}
+	return unrecognized
+}
+
+func containsOption(numbers []uint16, number uint16) bool {
+	for _, n := range numbers {
+		if n == number {
+			return true
+		}
+	}
+	return false
+}
+
+// Option is a single option instance. An option number may occur several
+// times in a packet, in which case the order of the instances is kept.
+type Option struct {
+	Number uint16
+	Value  []byte
+}
+
+// Options returns all options sorted by option number.
+func (p *CoapPacket) Options() []Option {
+	opts := make([]Option, len(p.options))
+	copy(opts, p.options)
+	sort.SliceStable(opts, func(i, j int) bool {
+		return opts[i].Number < opts[j].Number
+	})
+
+	return opts
+}
+
+func (p *CoapPacket) HasOption(num uint16) bool {
+	_, ok := p.OpaqueOption(num)
+	return ok
+}
+
+// AddOption appends an instance of an option, keeping existing ones.
+func (p *CoapPacket) AddOption(num uint16, value []byte) {
+	p.options = append(p.options, Option{num, value})
+}
+
+// SetOption replaces all instances of an option with a single one.
+func (p *CoapPacket) SetOption(num uint16, value []byte) {
+	p.RemoveOption(num)
+	p.AddOption(num, value)
+}
+
+func (p *CoapPacket) RemoveOption(num uint16) {
+	opts := p.options[:0]
+	for _, opt := range p.options {
+		if opt.Number != num {
+			opts = append(opts, opt)
+		}
+	}
+	p.options = opts
+}
+
+//------ opaque ----------
+
+// OpaqueOption returns the value of the first instance of an option.
+func (p *CoapPacket) OpaqueOption(num uint16) ([]byte, bool) {
+	for _, opt := range p.options {
+		if opt.Number == num {
+			return opt.Value, true
+		}
+	}
+	return nil, false
+}
+
+// OpaqueOptions returns values of all instances of an option.
+func (p *CoapPacket) OpaqueOptions(num uint16) [][]byte {
+	var values [][]byte
+	for _, opt := range p.options {
+		if opt.Number == num {
+			values = append(values, opt.Value)
+		}
+	}
+	return values
+}
+
+func (p *CoapPacket) SetOpaqueOption(num uint16, value []byte) {
+	p.SetOption(num, value)
+}
+
+func (p *CoapPacket) AddOpaqueOption(num uint16, value []byte) {
+	p.AddOption(num, value)
+}
+
+//------ uint ----------
+
+// UintOption returns false when option is not present or its value is longer than 4 bytes.
+func (p *CoapPacket) UintOption(num uint16) (uint32, bool) {
+	val, ok := p.OpaqueOption(num)
+	if !ok || len(val) > 4 {
+		return 0, false
+	}
+	return readUint32(val), true
+}
+
+func (p *CoapPacket) SetUintOption(num uint16, value uint32) {
+	p.SetOption(num, writeDynamicUint32(value))
+}
+
+func (p *CoapPacket) AddUintOption(num uint16, value uint32) {
+	p.AddOption(num, writeDynamicUint32(value))
+}
+
+//------ string ----------
+
+func (p *CoapPacket) StringOption(num uint16) (string, bool) {
+	val, ok := p.OpaqueOption(num)
+	return string(val), ok
+}
+
+func (p *CoapPacket) StringOptions(num uint16) []string {
+	var values []string
+	for _, val := range p.OpaqueOptions(num) {
+		values = append(values, string(val))
+	}
+	return values
+}
+
+func (p *CoapPacket) SetStringOption(num uint16, value string) {
+	p.SetOption(num, []byte(value))
+}
+
+func (p *CoapPacket) AddStringOption(num uint16, value string) {
+	p.AddOption(num, []byte(value))
+}
+
+//------ empty ----------
+
+func (p *CoapPacket) SetEmptyOption(num uint16) {
+	p.SetOption(num, []byte{})
+}
+
+//------ well known options ----------
+
+// UriPath returns all Uri-Path options joined into a path, for example "/test/2".
+func (p *CoapPacket) UriPath() string {
+	path := strings.Builder{}
+	for _, segment := range p.StringOptions(OPT_URI_PATH) {
+		path.WriteString("/")
+		path.WriteString(segment)
+	}
+	return path.String()
+}
+
+func (p *CoapPacket) SetUriPath(uriPath string) {
+	p.RemoveOption(OPT_URI_PATH)
+
+	uriPath = strings.TrimPrefix(uriPath, "/")
+	if uriPath == "" {
+		return
+	}
+	for _, segment := range strings.Split(uriPath, "/") {
+		p.AddStringOption(OPT_URI_PATH, segment)
+	}
+}
+
+// ContentFormat returns -1 when the option is not present.
+func (p *CoapPacket) ContentFormat() int16 {
+	cf, ok := p.UintOption(OPT_CONTENT_FORMAT)
+	if !ok {
+		return -1
+	}
+	return int16(cf)
+}
+
+// SetContentFormat removes the option when contentFormat is negative.
+func (p *CoapPacket) SetContentFormat(contentFormat int16) {
+	if contentFormat < 0 {
+		p.RemoveOption(OPT_CONTENT_FORMAT)
+		return
+	}
+	p.SetUintOption(OPT_CONTENT_FORMAT, uint32(contentFormat))
+}
+
+// Accept returns content format preferred by the client, -1 when the option is not present.
+func (p *CoapPacket) Accept() int16 {
+	accept, ok := p.UintOption(OPT_ACCEPT)
+	if !ok {
+		return -1
+	}
+	return int16(accept)
+}
+
+// SetAccept removes the option when contentFormat is negative.
+func (p *CoapPacket) SetAccept(contentFormat int16) {
+	if contentFormat < 0 {
+		p.RemoveOption(OPT_ACCEPT)
+		return
+	}
+	p.SetUintOption(OPT_ACCEPT, uint32(contentFormat))
+}
+
+// MaxAge returns DEFAULT_MAX_AGE when the option is not present.
+func (p *CoapPacket) MaxAge() uint32 {
+	maxAge, ok := p.UintOption(OPT_MAX_AGE)
+	if !ok {
+		return DEFAULT_MAX_AGE
+	}
+	return maxAge
+}
+
+// SetMaxAge removes the option when maxAge equals the default value.
+func (p *CoapPacket) SetMaxAge(maxAge uint32) {
+	if maxAge == DEFAULT_MAX_AGE {
+		p.RemoveOption(OPT_MAX_AGE)
+		return
+	}
+	p.SetUintOption(OPT_MAX_AGE, maxAge)
+}
@@ -19,6 +19,7 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // https://tools.ietf.org/html/rfc8323#page-7
@@ -28,12 +29,16 @@ type CoapPacket struct {
 	token   []byte
 	Payload []byte
 
-	//options
-	UriPath       string
-	MaxAge        uint32
-	ContentFormat int16
+	options []Option
 
 	CSM *Capabilities
+
+	//set by server on Observe registration requests
+	observer *Observer
+	//path parameters matched by Router
+	params map[string]string
+	//connection the request was received on, set by server
+	session *Session
 }
 
 type Capabilities struct {
@@ -42,7 +47,7 @@ type Capabilities struct {
 }
 
 func NewCoapPacket(code uint8, payload []byte) *CoapPacket {
-	return &CoapPacket{code, []byte{}, payload, "", 60, -1, nil}
+	return &CoapPacket{Code: code, token: []byte{}, Payload: payload}
 }
 
 const (
@@ -57,11 +62,12 @@ const (
 	c7xx = 7 << 5
 
 	//https://tools.ietf.org/html/rfc7252#section-12.1.2
-	CODE_201_CREATED = c2xx + 1
-	CODE_202_DELETED = c2xx + 2
-	CODE_203_VALID   = c2xx + 3 //0x43
-	CODE_204_CHANGED = c2xx + 4
-	CODE_205_CONTENT = c2xx + 5
+	CODE_201_CREATED  = c2xx + 1
+	CODE_202_DELETED  = c2xx + 2
+	CODE_203_VALID    = c2xx + 3 //0x43
+	CODE_204_CHANGED  = c2xx + 4
+	CODE_205_CONTENT  = c2xx + 5
+	CODE_231_CONTINUE = c2xx + 31
 
 	CODE_400_BAD_REQUEST                = c4xx + 0
 	CODE_401_UNAUTHORIZED               = c4xx + 1
@@ -70,6 +76,7 @@ const (
 	CODE_404_NOT_FOUND                  = c4xx + 4
 	CODE_405_METHOD_NOT_ALLOWED         = c4xx + 5
 	CODE_406_NOT_ACCEPTABLE             = c4xx + 6
+	CODE_408_REQUEST_ENTITY_INCOMPLETE  = c4xx + 8
 	CODE_412_PRECONDITION_FAILED        = c4xx + 12
 	CODE_413_REQUEST_ENTITY_TOO_LARGE   = c4xx + 13
 	CODE_415_UNSUPPORTED_CONTENT_FORMAT = c4xx + 15
@@ -81,15 +88,18 @@ const (
 	CODE_504_GATEWAY_TIMEOUT        = c5xx + 4
 	CODE_505_PROXYING_NOT_SUPPORTED = c5xx + 5
 
-	CODE_701_CSM  = c7xx + 1
-	CODE_702_PING = c7xx + 2
-	CODE_703_PONG = c7xx + 3
+	CODE_701_CSM     = c7xx + 1
+	CODE_702_PING    = c7xx + 2
+	CODE_703_PONG    = c7xx + 3
+	CODE_704_RELEASE = c7xx + 4
+	CODE_705_ABORT   = c7xx + 5
 
 	MT_TEXT_PLAIN               = 0
 	MT_APPLICATION_LINK_FORMAT  = 40
 	MT_APPLICATION_XML          = 41
 	MT_APPLICATION_OCTET_STREAM = 42
 	MT_APPLICATION_JSON         = 50
+	MT_APPLICATION_CBOR         = 60
 )
 
 /*
@@ -106,7 +116,14 @@ const (
    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 */
 func ReadCoap(reader io.Reader) (*CoapPacket, error) {
-	var coapPacket CoapPacket = CoapPacket{0, nil, nil, "", 60, -1, nil}
+	return ReadCoapWithLimit(reader, 0)
+}
+
+// ReadCoapWithLimit reads a message that is not larger than maxSize bytes, 0 means no limit.
+// A larger message is skipped without being buffered and MessageTooLargeError is returned
+// together with a packet that has only code and token set.
+func ReadCoapWithLimit(reader io.Reader, maxSize uint32) (*CoapPacket, error) {
+	var coapPacket CoapPacket = CoapPacket{}
 
 	bufSingle := make([]byte, 1)
 	_, err := io.ReadFull(reader, bufSingle)
@@ -119,14 +136,41 @@ func ReadCoap(reader io.Reader) (*CoapPacket, error) {
 	if err != nil {
 		return nil, err
 	}
+	if tklLen > 8 {
+		return nil, &MessageFormatError{fmt.Sprintf("token length %d", tklLen)}
+	}
 
 	var totalCoapSize = len + uint32(tklLen+1)
+	var frameSize = 1 + extendedLenSize(bufSingle[0]) + totalCoapSize
+	if maxSize > 0 && frameSize > maxSize {
+		head := make([]byte, tklLen+1)
+		_, err = io.ReadFull(reader, head)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.CopyN(io.Discard, reader, int64(len))
+		if err != nil {
+			return nil, err
+		}
+
+		coapPacket.Code = head[0]
+		coapPacket.token = head[1:]
+		return &coapPacket, &MessageTooLargeError{frameSize, maxSize}
+	}
+
 	buf := make([]byte, totalCoapSize)
 	_, err = io.ReadFull(reader, buf)
 	if err != nil {
 		return nil, err
 	}
 
+	return decodeMessage(buf, tklLen)
+}
+
+// decodeMessage parses code, token, options and payload, buf starts with the code byte
+func decodeMessage(buf []byte, tklLen byte) (*CoapPacket, error) {
+	var coapPacket CoapPacket = CoapPacket{}
+	var totalCoapSize = uint32(len(buf))
 	var index uint32 = 0
 
 	coapPacket.Code = buf[index]
@@ -134,57 +178,120 @@ func ReadCoap(reader io.Reader) (*CoapPacket, error) {
 	index += uint32(tklLen + 1)
 
 	//parse options
-	var optNum uint8 = 0
+	var optNum uint32 = 0
 	for totalCoapSize > index && buf[index] != 0xFF {
-		optDelta := buf[index] >> 4
-		optLen := uint32(buf[index] & 0x0f)
-		if optDelta == 13 {
-			index++
-			optDelta += buf[index]
+		optHeader := buf[index]
+		index++
+
+		optDelta, err := readOptionExt(buf, &index, optHeader>>4)
+		if err != nil {
+			return nil, err
 		}
-		if optLen == 13 {
-			index++
-			optLen += uint32(buf[index])
+		optLen, err := readOptionExt(buf, &index, optHeader&0x0F)
+		if err != nil {
+			return nil, err
 		}
 
 		optNum += optDelta
-		optVal := buf[index+1 : index+1+optLen]
-
-		index += 1 + optLen
-
-		switch optNum {
-		case 2: //csm
-			if coapPacket.Code == CODE_701_CSM {
-				csm := Capabilities{readUint32(optVal), false}
-				coapPacket.CSM = &csm
-			}
-		case 4: //csm
-			if coapPacket.Code == CODE_701_CSM {
-				if coapPacket.CSM != nil {
-					coapPacket.CSM.BlockWiseTransfer = true
-				} else {
-					csm := Capabilities{1152, true}
-					coapPacket.CSM = &csm
-				}
-			}
-		case 11: //uri-path
-			coapPacket.UriPath += "/" + string(optVal)
-		case 12: //content-format
-			coapPacket.ContentFormat = int16(optVal[0])
-		case 14: //max-age
-			coapPacket.MaxAge = readUint32(optVal)
+		if optNum > 0xFFFF {
+			return nil, &MessageFormatError{"option number out of range"}
 		}
+		if totalCoapSize-index < optLen {
+			return nil, &TruncatedFrameError{index + optLen, totalCoapSize}
+		}
+		optVal := buf[index : index+optLen]
+
+		index += optLen
+
+		coapPacket.AddOption(uint16(optNum), optVal)
 	}
 
 	if totalCoapSize > index && buf[index] == 0xFF {
+		if totalCoapSize == index+1 {
+			return nil, &MessageFormatError{"payload marker followed by empty payload"}
+		}
 		coapPacket.Payload = buf[index+1:]
 	} else {
 		coapPacket.Payload = buf[0:0]
 	}
 
+	if coapPacket.Code >= c7xx {
+		err := verifySignalOptions(&coapPacket)
+		if err != nil {
+			return &coapPacket, err
+		}
+	}
+
+	if coapPacket.Code == CODE_701_CSM {
+		coapPacket.CSM = readCapabilities(&coapPacket)
+	}
+
 	return &coapPacket, nil
 }
 
+// verifySignalOptions rejects critical (odd) options in signaling messages,
+// none of them is defined in https://tools.ietf.org/html/rfc8323#section-5
+func verifySignalOptions(p *CoapPacket) error {
+	for _, opt := range p.options {
+		if IsCritical(opt.Number) {
+			return &UnknownCriticalOptionError{p.Code, opt.Number}
+		}
+	}
+	if maxSize, ok := p.OpaqueOption(OPT_CSM_MAX_MESSAGE_SIZE); ok && p.Code == CODE_701_CSM && len(maxSize) > 4 {
+		return &BadOptionError{OPT_CSM_MAX_MESSAGE_SIZE, "value longer than 4 bytes"}
+	}
+	return nil
+}
+
+// readCapabilities decodes CSM options, absent options take default values
+func readCapabilities(p *CoapPacket) *Capabilities {
+	csm := Capabilities{1152, false}
+	if maxSize, ok := p.UintOption(OPT_CSM_MAX_MESSAGE_SIZE); ok {
+		csm.MaxMessageSize = maxSize
+	}
+	csm.BlockWiseTransfer = p.HasOption(OPT_CSM_BLOCK_WISE_TRANSFER)
+
+	return &csm
+}
+
+// readOptionExt decodes option delta or length nibble with its extended bytes
+// https://tools.ietf.org/html/rfc7252#section-3.1
+func readOptionExt(buf []byte, index *uint32, nibble byte) (uint32, error) {
+	switch nibble {
+	case 13:
+		if uint32(len(buf))-*index < 1 {
+			return 0, &TruncatedFrameError{*index + 1, uint32(len(buf))}
+		}
+		value := uint32(buf[*index]) + 13
+		*index += 1
+		return value, nil
+	case 14:
+		if uint32(len(buf))-*index < 2 {
+			return 0, &TruncatedFrameError{*index + 2, uint32(len(buf))}
+		}
+		value := readUint32(buf[*index:*index+2]) + 269
+		*index += 2
+		return value, nil
+	case 15:
+		return 0, &MessageFormatError{"reserved option nibble 15"}
+	default:
+		return uint32(nibble), nil
+	}
+}
+
+func extendedLenSize(hdrByte byte) uint32 {
+	switch hdrByte >> 4 {
+	case 13:
+		return 1
+	case 14:
+		return 2
+	case 15:
+		return 3
+	default:
+		return 0
+	}
+}
+
 func readLen(reader io.Reader, hdrByte byte) (uint32, error) {
 	var len = uint32(hdrByte >> 4)
 
@@ -209,9 +316,33 @@ func readLen(reader io.Reader, hdrByte byte) (uint32, error) {
 }
 
 func (p CoapPacket) Write(writer io.Writer) error {
+	return p.WriteWithLimit(writer, 0)
+}
+
+// WriteWithLimit refuses to write a message larger than maxSize bytes, 0 means no limit.
+// Nothing is written when MessageTooLargeError is returned.
+func (p CoapPacket) WriteWithLimit(writer io.Writer, maxSize uint32) error {
+	frame, err := p.encode()
+	if err != nil {
+		return err
+	}
+
+	if maxSize > 0 && uint32(len(frame)) > maxSize {
+		return &MessageTooLargeError{uint32(len(frame)), maxSize}
+	}
+
+	_, err = writer.Write(frame)
+	return err
+}
+
+func (p CoapPacket) encode() ([]byte, error) {
+	writer := new(bytes.Buffer)
 
 	//options
-	optBytes := p.writeOptions()
+	optBytes, err := p.writeOptions()
+	if err != nil {
+		return nil, err
+	}
 
 	msgLen := len(optBytes) + len(p.Payload)
 
@@ -220,24 +351,27 @@ func (p CoapPacket) Write(writer io.Writer) error {
 	}
 
 	//LEN | TKL
-	var err error
 	if msgLen < 13 {
 		firstByte := byte(msgLen<<4) + byte(len(p.token))
-		_, err = writer.Write([]byte{firstByte})
+		writer.Write([]byte{firstByte})
 	} else if msgLen < 269 {
 		firstByte := byte(13<<4) + byte(len(p.token))
-		_, err = writer.Write([]byte{firstByte, byte(msgLen - 13)})
+		writer.Write([]byte{firstByte, byte(msgLen - 13)})
 	} else if msgLen < 65805 {
 		firstByte := byte(14<<4) + byte(len(p.token))
-		_, err = writer.Write([]byte{firstByte, byte((msgLen - 269) >> 8), byte((msgLen - 269) & 0xFF)})
+		writer.Write([]byte{firstByte, byte((msgLen - 269) >> 8), byte((msgLen - 269) & 0xFF)})
 	} else {
 		firstByte := byte(15<<4) + byte(len(p.token))
-		_, err = writer.Write([]byte{firstByte, byte((msgLen - 65805) >> 16), byte((msgLen - 65805) >> 8), byte((msgLen - 65805) & 0xFF)})
-	}
-	if err != nil {
-		return err
+		writer.Write([]byte{firstByte, byte((msgLen - 65805) >> 16), byte((msgLen - 65805) >> 8), byte((msgLen - 65805) & 0xFF)})
 	}
 
+	p.writeMessage(writer, optBytes)
+
+	return writer.Bytes(), nil
+}
+
+// writeMessage writes everything that follows the length header
+func (p CoapPacket) writeMessage(writer *bytes.Buffer, optBytes []byte) {
 	//Code, token, options
 	writer.Write([]byte{p.Code})
 
@@ -245,41 +379,120 @@ func (p CoapPacket) Write(writer io.Writer) error {
 	writer.Write(p.token)
 
 	//Options
-	_, err = writer.Write(optBytes)
-	if err != nil {
-		return err
-	}
+	writer.Write(optBytes)
 
 	//Payload
 	if len(p.Payload) > 0 {
 		writer.Write([]byte{0xFF})
-		_, err = writer.Write(p.Payload)
-		if err != nil {
-			return err
-		}
+		writer.Write(p.Payload)
 	}
+}
 
-	return nil
+// MarshalWebSocket encodes message without length, as carried in a WebSocket binary frame
+// https://tools.ietf.org/html/rfc8323#section-4.2
+func (p CoapPacket) MarshalWebSocket() ([]byte, error) {
+	optBytes, err := p.writeOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	writer := new(bytes.Buffer)
+	writer.Write([]byte{byte(len(p.token))})
+	p.writeMessage(writer, optBytes)
+
+	return writer.Bytes(), nil
 }
 
+// UnmarshalWebSocket decodes message carried in a WebSocket binary frame, Len field must be 0
+func UnmarshalWebSocket(data []byte) (*CoapPacket, error) {
+	if len(data) < 2 {
+		return nil, &TruncatedFrameError{2, uint32(len(data))}
+	}
+	if data[0]>>4 != 0 {
+		return nil, &MessageFormatError{"length in WebSocket message"}
+	}
+
+	tklLen := data[0] & 0x0F
+	if tklLen > 8 {
+		return nil, &MessageFormatError{fmt.Sprintf("token length %d", tklLen)}
+	}
+	if uint32(len(data)) < uint32(tklLen)+2 {
+		return nil, &TruncatedFrameError{uint32(tklLen) + 2, uint32(len(data))}
+	}
+
+	return decodeMessage(data[1:], tklLen)
+}
+
+// ResponseCode creates a response that echoes the token of the request.
 func (p *CoapPacket) ResponseCode(code uint8) *CoapPacket {
-	return NewCoapPacket(code, []byte{})
+	resp := NewCoapPacket(code, []byte{})
+	resp.token = p.token
+
+	return resp
 }
 
 func (p *CoapPacket) Response(code uint8, contentFormat int16, payload []byte) *CoapPacket {
-	resp := NewCoapPacket(code, payload)
-	resp.ContentFormat = contentFormat
+	resp := p.ResponseCode(code)
+	resp.Payload = payload
+	resp.SetContentFormat(contentFormat)
 
 	return resp
 }
 
 func (p *CoapPacket) ResponseText(code uint8, payload string) *CoapPacket {
-	resp := NewCoapPacket(code, []byte(payload))
-	resp.ContentFormat = 0
+	resp := p.ResponseCode(code)
+	resp.Payload = []byte(payload)
+	resp.SetContentFormat(MT_TEXT_PLAIN)
 
 	return resp
 }
 
+// NewAbort creates Abort signal with a diagnostic payload
+// https://tools.ietf.org/html/rfc8323#section-5.6
+func NewAbort(diagnostic string) *CoapPacket {
+	return NewCoapPacket(CODE_705_ABORT, []byte(diagnostic))
+}
+
+// NewRelease creates Release signal, empty alternativeAddress and zero holdOff are omitted
+// https://tools.ietf.org/html/rfc8323#section-5.5
+func NewRelease(alternativeAddress string, holdOff time.Duration) *CoapPacket {
+	release := NewCoapPacket(CODE_704_RELEASE, []byte{})
+	if alternativeAddress != "" {
+		release.SetStringOption(OPT_RELEASE_ALTERNATIVE_ADDRESS, alternativeAddress)
+	}
+	if holdOff > 0 {
+		release.SetUintOption(OPT_RELEASE_HOLD_OFF, uint32((holdOff+time.Second-1)/time.Second))
+	}
+	return release
+}
+
+// AlternativeAddresses returns addresses of a Release signal where the peer may reconnect
+func (p *CoapPacket) AlternativeAddresses() []string {
+	if p.Code != CODE_704_RELEASE {
+		return nil
+	}
+	return p.StringOptions(OPT_RELEASE_ALTERNATIVE_ADDRESS)
+}
+
+// HoldOff returns how long the peer should wait before reconnecting after a Release signal,
+// 0 when not set
+func (p *CoapPacket) HoldOff() time.Duration {
+	if p.Code != CODE_704_RELEASE {
+		return 0
+	}
+	holdOff, _ := p.UintOption(OPT_RELEASE_HOLD_OFF)
+	return time.Duration(holdOff) * time.Second
+}
+
+// BadCSMOption returns number of the CSM option that caused an Abort signal
+func (p *CoapPacket) BadCSMOption() (uint16, bool) {
+	if p.Code != CODE_705_ABORT {
+		return 0, false
+	}
+	number, ok := p.UintOption(OPT_ABORT_BAD_CSM_OPTION)
+	return uint16(number), ok
+}
+
 func (p *CoapPacket) String() string {
 	coapTxt := strings.Builder{}
 	coapTxt.WriteString("[")
@@ -287,17 +500,31 @@ func (p *CoapPacket) String() string {
 	if len(p.token) > 0 {
 		coapTxt.WriteString(fmt.Sprintf(", token:%x", p.token))
 	}
-	if p.UriPath != "" {
+	if p.HasOption(OPT_URI_PATH) {
 		coapTxt.WriteString(", uri:")
-		coapTxt.WriteString(p.UriPath)
+		coapTxt.WriteString(p.UriPath())
+	}
+	if p.HasOption(OPT_URI_QUERY) {
+		coapTxt.WriteString(", query:")
+		coapTxt.WriteString(strings.Join(p.UriQuery(), "&"))
 	}
-	if p.ContentFormat >= 0 {
+	if p.HasOption(OPT_LOCATION_PATH) || p.HasOption(OPT_LOCATION_QUERY) {
+		coapTxt.WriteString(", location:")
+		coapTxt.WriteString(p.Location().String())
+	}
+	if p.HasOption(OPT_CONTENT_FORMAT) {
 		coapTxt.WriteString(", ct:")
-		coapTxt.WriteString(strconv.Itoa(int(p.ContentFormat)))
+		coapTxt.WriteString(strconv.Itoa(int(p.ContentFormat())))
 	}
 	if len(p.Payload) > 0 {
 		coapTxt.WriteString(", max-age:")
-		coapTxt.WriteString(strconv.Itoa(int(p.MaxAge)))
+		coapTxt.WriteString(strconv.Itoa(int(p.MaxAge())))
+	}
+	if block, ok := p.Block1(); ok {
+		coapTxt.WriteString(", block1:" + block.String())
+	}
+	if block, ok := p.Block2(); ok {
+		coapTxt.WriteString(", block2:" + block.String())
 	}
 	if p.CSM != nil {
 		coapTxt.WriteString(fmt.Sprintf(", max-msg-size: %d, block: %t", p.CSM.MaxMessageSize, p.CSM.BlockWiseTransfer))
@@ -313,6 +540,14 @@ func (p *CoapPacket) String() string {
 	return coapTxt.String()
 }
 
+func isRequest(code uint8) bool {
+	return code > 0 && code < 32
+}
+
+func isResponse(code uint8) bool {
+	return code>>5 >= 2 && code>>5 <= 5
+}
+
 func (p *CoapPacket) StringCode() string {
 	switch p.Code {
 	case GET:
@@ -330,96 +565,71 @@ func (p *CoapPacket) StringCode() string {
 
 }
 
-func delta(lastOptNum *byte, optionNumber byte) byte {
+func delta(lastOptNum *uint16, optionNumber uint16) uint16 {
 	delta := optionNumber - *lastOptNum
 
 	*lastOptNum = optionNumber
 	return delta
 }
 
-func (p *CoapPacket) writeOptions() []byte {
+func (p *CoapPacket) writeOptions() ([]byte, error) {
 	optWriter := new(bytes.Buffer)
-	lastOptNum := byte(0)
-
-	//#2
-	if p.CSM != nil {
-		p.writeOptionHeader(optWriter, delta(&lastOptNum, 2), writeDynamicUint32(p.CSM.MaxMessageSize))
-	}
+	lastOptNum := uint16(0)
 
-	//#4
-	if p.CSM != nil && p.CSM.BlockWiseTransfer {
-		p.writeOptionHeader(optWriter, delta(&lastOptNum, 4), []byte{})
-	}
-
-	//#11 uri-path
-	if p.UriPath != "" {
-
-		uriPaths := strings.Split(p.UriPath, "/")
-		p.writeOptionHeader(optWriter, delta(&lastOptNum, 11), []byte(uriPaths[1]))
-
-		for i := 2; i < len(uriPaths); i++ {
-			p.writeOptionHeader(optWriter, 0, []byte(uriPaths[i]))
+	for _, opt := range p.optionsToWrite() {
+		if len(opt.Value) > MAX_OPTION_LENGTH {
+			return nil, fmt.Errorf("option %d too long: %d bytes", opt.Number, len(opt.Value))
 		}
+		p.writeOptionHeader(optWriter, delta(&lastOptNum, opt.Number), opt.Value)
 	}
 
-	//#12 content-format
-	if p.ContentFormat >= 0 {
-		p.writeOptionHeader(optWriter, delta(&lastOptNum, 12), []byte{byte(p.ContentFormat)})
+	return optWriter.Bytes(), nil
+}
+
+// optionsToWrite returns sorted options, with CSM options taken from the CSM field
+func (p *CoapPacket) optionsToWrite() []Option {
+	if p.CSM == nil {
+		return p.Options()
 	}
 
-	//#14 max-age
-	if p.MaxAge != 60 {
-		p.writeOptionHeader(optWriter, delta(&lastOptNum, 14), writeDynamicUint32(p.MaxAge))
+	csmPacket := CoapPacket{options: append([]Option{}, p.options...)}
+	csmPacket.RemoveOption(OPT_CSM_MAX_MESSAGE_SIZE)
+	csmPacket.RemoveOption(OPT_CSM_BLOCK_WISE_TRANSFER)
+	csmPacket.AddUintOption(OPT_CSM_MAX_MESSAGE_SIZE, p.CSM.MaxMessageSize)
+	if p.CSM.BlockWiseTransfer {
+		csmPacket.AddOption(OPT_CSM_BLOCK_WISE_TRANSFER, []byte{})
 	}
 
-	return optWriter.Bytes()
+	return csmPacket.Options()
 }
 
-func (p *CoapPacket) writeOptionHeader(optWriter *bytes.Buffer, delta byte, data []byte) {
-	size := byte(len(data))
-	if delta <= 12 && size <= 12 {
-		optWriter.WriteByte(delta<<4 + size)
-	} else if delta <= 12 && size > 12 {
-		optWriter.WriteByte(delta<<4 + 13)
-		optWriter.WriteByte(size - 13)
-	} else if delta > 12 && size < 12 {
-		optWriter.WriteByte(13<<4 + size)
-	} else {
-		optWriter.WriteByte(13<<4 + 13)
-		optWriter.WriteByte(delta - 13)
-		optWriter.WriteByte(size - 13)
-	}
+func (p *CoapPacket) writeOptionHeader(optWriter *bytes.Buffer, delta uint16, data []byte) {
+	deltaNibble, deltaExt := optionExt(uint32(delta))
+	lenNibble, lenExt := optionExt(uint32(len(data)))
 
+	optWriter.WriteByte(deltaNibble<<4 + lenNibble)
+	optWriter.Write(deltaExt)
+	optWriter.Write(lenExt)
 	optWriter.Write(data)
 }
 
-func (p *CoapPacket) writeOptionHeaderDynamicSize(optWriter *bytes.Buffer, delta byte, data []byte) {
-	minData := data
-
-	for minData[0] == 0 && len(minData) > 1 {
-		minData = minData[1:]
+func optionExt(value uint32) (byte, []byte) {
+	if value < 13 {
+		return byte(value), nil
+	} else if value < 269 {
+		return 13, []byte{byte(value - 13)}
+	} else {
+		return 14, []byte{byte((value - 269) >> 8), byte((value - 269) & 0xFF)}
 	}
-
-	p.writeOptionHeader(optWriter, delta, minData)
 }
 
+// readUint32 decodes big endian unsigned integer, only last 4 bytes are significant
 func readUint32(data []byte) uint32 {
-	size := len(data)
-
-	switch size {
-	case 0:
-		return 0
-	case 1:
-		return uint32(data[0])
-	case 2:
-		return uint32(data[0])<<8 + uint32(data[1])
-	case 3:
-		return uint32(data[0])<<16 + uint32(data[1])<<8 + uint32(data[2])
-	case 4:
-		return uint32(data[0])<<24 + uint32(data[1])<<16 + uint32(data[2])<<8 + uint32(data[3])
-	default:
-		panic("not supported")
+	var value uint32 = 0
+	for _, b := range data {
+		value = value<<8 + uint32(b)
 	}
+	return value
 }
 
 func writeDynamicUint32(data uint32) []byte {
@@ -15,9 +15,12 @@ package coap
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"net/url"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestReadCoap_simplest(t *testing.T) {
@@ -69,7 +72,7 @@ func TestReadCoap_withUriPath(t *testing.T) {
 	coap, _ := readCoap([]byte{0x70, 0x43, 0xb4, 't', 'e', 's', 't', 0x01, '2'})
 
 	expectedPacket := NewCoapPacket(CODE_203_VALID, []byte{})
-	expectedPacket.UriPath = "/test/2"
+	expectedPacket.SetUriPath("/test/2")
 	assert(t, expectedPacket, coap)
 }
 
@@ -78,7 +81,7 @@ func TestReadCoap_withMaxAge(t *testing.T) {
 	coap, _ := readCoap([]byte{0x40, 0x43, 0xd2, 0x01, 0x01, 0xF0})
 
 	expectedPacket := NewCoapPacket(CODE_203_VALID, []byte{})
-	expectedPacket.MaxAge = 0x01F0
+	expectedPacket.SetMaxAge(0x01F0)
 	assert(t, expectedPacket, coap)
 }
 
@@ -87,10 +90,304 @@ func TestReadCoap_withContentFormat(t *testing.T) {
 	coap, _ := readCoap([]byte{0x20, 0x43, 0xc1, 42})
 
 	expectedPacket := NewCoapPacket(CODE_203_VALID, []byte{})
-	expectedPacket.ContentFormat = MT_APPLICATION_OCTET_STREAM
+	expectedPacket.SetContentFormat(MT_APPLICATION_OCTET_STREAM)
 	assert(t, expectedPacket, coap)
 }
 
+func TestReadCoap_keepsUnknownOptions(t *testing.T) {
+
+	coap, _ := readCoap([]byte{0x60, 0x43, 0x31, 0x01, 0x10, 0xd1, 0x0d, 0x02})
+
+	expectedPacket := NewCoapPacket(CODE_203_VALID, []byte{})
+	expectedPacket.AddUintOption(3, 1)
+	expectedPacket.AddOption(4, []byte{})
+	expectedPacket.AddUintOption(30, 2)
+	assert(t, expectedPacket, coap)
+}
+
+func TestWriteCoap_sortsOptions(t *testing.T) {
+
+	coap := NewCoapPacket(CODE_205_CONTENT, []byte{})
+	coap.SetUintOption(30, 2)
+	coap.AddStringOption(OPT_URI_PATH, "a")
+	coap.SetEmptyOption(4)
+	coap.AddStringOption(OPT_URI_PATH, "b")
+	w := new(bytes.Buffer)
+
+	if coap.Write(w) != nil {
+		t.Errorf("Error")
+	}
+
+	expected := []byte{0x80, 0x45, 0x40, 0x71, 'a', 0x01, 'b', 0xd1, 0x06, 0x02}
+	if !(bytes.Equal(w.Bytes(), expected)) {
+		t.Errorf("Wrong: %#v", w.Bytes())
+	}
+}
+
+func TestReadWriteCoap_extendedOptions(t *testing.T) {
+
+	coap := NewCoapPacket(CODE_205_CONTENT, []byte("test"))
+	coap.AddOption(12, make([]byte, 13))
+	coap.AddOption(300, make([]byte, 300))
+	coap.AddOption(65000, make([]byte, 65000))
+	coap.AddStringOption(65535, "last")
+
+	assert(t, coap, writeAndRead(coap, t))
+}
+
+func TestWriteCoap_extendedOptionHeader(t *testing.T) {
+
+	coap := NewCoapPacket(CODE_205_CONTENT, []byte{})
+	coap.AddOption(270, make([]byte, 269))
+	w := new(bytes.Buffer)
+
+	if coap.Write(w) != nil {
+		t.Errorf("Error")
+	}
+
+	if !(bytes.Equal(w.Bytes()[:8], []byte{0xe0, 0x00, 0x05, 0x45, 0xee, 0x00, 0x01, 0x00})) {
+		t.Errorf("Wrong: %#v", w.Bytes()[:8])
+	}
+}
+
+func TestReadCoap_reservedOptionNibble(t *testing.T) {
+
+	_, err := ReadCoap(bytes.NewBuffer([]byte{0x20, 0x43, 0xf1, 0x00}))
+	if err == nil {
+		t.Errorf("Expected error")
+	}
+
+	_, err = ReadCoap(bytes.NewBuffer([]byte{0x20, 0x43, 0x1f, 0x00}))
+	if err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestReadCoap_malformed(t *testing.T) {
+	var formatErr *MessageFormatError
+	var truncatedErr *TruncatedFrameError
+	var badOptionErr *BadOptionError
+	var criticalErr *UnknownCriticalOptionError
+
+	tests := []struct {
+		raw    []byte
+		target interface{}
+	}{
+		{[]byte{0x09, 0x45, 1, 2, 3, 4, 5, 6, 7, 8, 9}, &formatErr},
+		{[]byte{0x10, 0x45, 0xd0}, &truncatedErr},
+		{[]byte{0x20, 0x45, 0xe0, 0x01}, &truncatedErr},
+		{[]byte{0x20, 0x45, 0x14, 0x01}, &truncatedErr},
+		{[]byte{0x10, 0x45, 0xFF}, &formatErr},
+		{[]byte{0x60, 0xE1, 0x25, 1, 2, 3, 4, 5}, &badOptionErr},
+		{[]byte{0x10, 0xE1, 0x30}, &criticalErr},
+	}
+
+	for _, test := range tests {
+		_, err := ReadCoap(bytes.NewBuffer(test.raw))
+		if !errors.As(err, test.target) {
+			t.Errorf("%x: unexpected error: %v", test.raw, err)
+		}
+	}
+}
+
+func TestReadCoap_neverPanics(t *testing.T) {
+
+	coap := NewCoapPacket(CODE_205_CONTENT, []byte("test"))
+	coap.token = []byte{0x01, 0x02}
+	coap.SetUriPath("/path1/long-path-long-path")
+	coap.AddOption(300, make([]byte, 300))
+	w := new(bytes.Buffer)
+	if coap.Write(w) != nil {
+		t.Errorf("Error")
+	}
+	raw := w.Bytes()
+
+	for i := 0; i < len(raw); i++ {
+		for _, b := range []byte{0x00, 0x0d, 0xd0, 0xdd, 0xe0, 0xee, 0xf0, 0xff} {
+			malformed := append([]byte{}, raw...)
+			malformed[i] = b
+			ReadCoap(bytes.NewBuffer(malformed))
+		}
+	}
+}
+
+func TestReadWriteCoap_withLimit(t *testing.T) {
+
+	coap := NewCoapPacket(CODE_205_CONTENT, make([]byte, 300))
+	coap.token = []byte{0x01, 0x02}
+	var tooLarge *MessageTooLargeError
+
+	w := new(bytes.Buffer)
+	if err := coap.WriteWithLimit(w, 300); !errors.As(err, &tooLarge) || w.Len() > 0 {
+		t.Errorf("Unexpected: %v, written: %d", err, w.Len())
+	}
+	if err := coap.WriteWithLimit(w, 307); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	//frame followed by another one
+	w.Write([]byte{0x00, 0x45})
+	reader := bytes.NewBuffer(w.Bytes())
+
+	skipped, err := ReadCoapWithLimit(reader, 306)
+	if !errors.As(err, &tooLarge) || tooLarge.Size != 307 || !bytes.Equal(skipped.token, coap.token) {
+		t.Errorf("Unexpected: %v", err)
+	}
+
+	next, err := ReadCoapWithLimit(reader, 306)
+	if err != nil || next.Code != CODE_205_CONTENT {
+		t.Errorf("Unexpected: %v", err)
+	}
+}
+
+func TestMarshalWebSocket(t *testing.T) {
+
+	coap := NewCoapPacket(CODE_205_CONTENT, []byte("test"))
+	coap.token = []byte{0x01, 0x02}
+	coap.SetUriPath("/path1")
+
+	data, err := coap.MarshalWebSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x02, 0x45, 0x01, 0x02, 0xB5, 'p', 'a', 't', 'h', '1', 0xFF, 't', 'e', 's', 't'}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("\nExpected: %x\n  Actual: %x", expected, data)
+	}
+
+	coap2, err := UnmarshalWebSocket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, coap, *coap2)
+
+	//length is not allowed
+	_, err = UnmarshalWebSocket([]byte{0x10, 0x45, 0x01})
+	var formatErr *MessageFormatError
+	if !errors.As(err, &formatErr) {
+		t.Errorf("Unexpected: %v", err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+
+	coap := NewCoapPacket(CODE_205_CONTENT, []byte{})
+	coap.AddStringOption(OPT_URI_PATH, "a")
+	coap.AddStringOption(OPT_URI_PATH, "b")
+	coap.SetContentFormat(MT_APPLICATION_JSON)
+
+	if coap.UriPath() != "/a/b" {
+		t.Errorf("Wrong uri-path: %v", coap.UriPath())
+	}
+	if coap.ContentFormat() != MT_APPLICATION_JSON {
+		t.Errorf("Wrong content-format: %v", coap.ContentFormat())
+	}
+	if coap.MaxAge() != DEFAULT_MAX_AGE {
+		t.Errorf("Wrong max-age: %v", coap.MaxAge())
+	}
+
+	coap.SetStringOption(OPT_URI_PATH, "c")
+	coap.SetContentFormat(-1)
+	if coap.UriPath() != "/c" || coap.HasOption(OPT_CONTENT_FORMAT) {
+		t.Errorf("Wrong: %v", coap)
+	}
+}
+
+func TestSetURL(t *testing.T) {
+	tests := []struct {
+		uri   string
+		host  string
+		port  uint16
+		path  []string
+		query []string
+		back  string
+	}{
+		{"coap://Example.com:5683/~sensors/temp.xml", "example.com", 0, []string{"~sensors", "temp.xml"}, nil, "coap://example.com/~sensors/temp.xml"},
+		{"coap://127.0.0.1:61616//%2F//?%2F%2F&?%26", "", 61616, []string{"", "/", "", ""}, []string{"//", "?&"}, "//%2F//?//&?%26"},
+		{"coaps+tcp://[::1]/sensors?unit=C&raw", "", 0, []string{"sensors"}, []string{"unit=C", "raw"}, "/sensors?unit=C&raw"},
+		{"coap+ws://host:8080/a%20b", "host", 8080, []string{"a b"}, nil, "coap+ws://host:8080/a%20b"},
+		{"/", "", 0, nil, nil, "/"},
+	}
+
+	for _, test := range tests {
+		u, _ := url.Parse(test.uri)
+		req := NewCoapPacket(GET, []byte{})
+		if err := req.SetURL(u); err != nil {
+			t.Fatal(err)
+		}
+
+		if req.UriHost() != test.host || req.UriPort() != test.port ||
+			!reflect.DeepEqual(req.StringOptions(OPT_URI_PATH), test.path) || !reflect.DeepEqual(req.UriQuery(), test.query) {
+			t.Errorf("%s\nUnexpected: %v %v %q %q", test.uri, req.UriHost(), req.UriPort(), req.StringOptions(OPT_URI_PATH), req.UriQuery())
+		}
+		if back := req.URL(u.Scheme).String(); back != test.back {
+			t.Errorf("%s\nExpected: %s\n  Actual: %s", test.uri, test.back, back)
+		}
+	}
+}
+
+func TestLocation(t *testing.T) {
+	resp := NewCoapPacket(CODE_201_CREATED, []byte{})
+	resp.SetLocationPath("/tmp/new item")
+	resp.AddLocationQuery("v", "1")
+	*resp = writeAndRead(resp, t)
+
+	if resp.LocationPath() != "/tmp/new item" || !reflect.DeepEqual(resp.LocationQuery(), []string{"v=1"}) {
+		t.Errorf("Unexpected: %v", resp)
+	}
+	requestURL, _ := url.Parse("coap://localhost:5683/tmp?x=1")
+	if location := resp.ResolveLocation(requestURL).String(); location != "coap://localhost:5683/tmp/new%20item?v=1" {
+		t.Errorf("Unexpected: %v", location)
+	}
+	if NewCoapPacket(CODE_204_CHANGED, []byte{}).Location() != nil {
+		t.Error("Expected no location")
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	etag := []byte{0x01}
+	tests := []struct {
+		ifMatch     [][]byte
+		ifNoneMatch bool
+		exists      bool
+		code        uint8
+	}{
+		{nil, false, true, 0},
+		{[][]byte{{0x01}}, false, true, 0},
+		{[][]byte{{0x02}, {0x01}}, false, true, 0},
+		{[][]byte{{0x02}}, false, true, CODE_412_PRECONDITION_FAILED},
+		{[][]byte{{}}, false, true, 0},
+		{[][]byte{{}}, false, false, CODE_412_PRECONDITION_FAILED},
+		{nil, true, false, 0},
+		{nil, true, true, CODE_412_PRECONDITION_FAILED},
+	}
+
+	for i, test := range tests {
+		req := NewCoapPacket(PUT, []byte{})
+		for _, tag := range test.ifMatch {
+			req.AddIfMatch(tag)
+		}
+		req.SetIfNoneMatch(test.ifNoneMatch)
+
+		resp := req.CheckPreconditions(etag, test.exists)
+		if (resp == nil && test.code != 0) || (resp != nil && resp.Code != test.code) {
+			t.Errorf("%d: Unexpected: %v", i, resp)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	req := NewCoapPacket(GET, []byte{})
+	req.AddUriQuery("unit", "C")
+	req.AddUriQuery("raw", "")
+	req.AddUriQuery("unit", "a=b")
+
+	query := req.Query()
+	if !reflect.DeepEqual(query["unit"], []string{"C", "a=b"}) || !query.Has("raw") {
+		t.Errorf("Unexpected: %v", query)
+	}
+}
+
 func TestWriteCoap_simplest(t *testing.T) {
 
 	coap := NewCoapPacket(CODE_205_CONTENT, []byte{})
@@ -134,9 +431,9 @@ func TestReadWriteCoap(t *testing.T) {
 	assert(t, coap2, writeAndRead(coap2, t))
 
 	//all options
-	coap2.ContentFormat = MT_APPLICATION_OCTET_STREAM
-	coap2.MaxAge = 100
-	coap2.UriPath = "/path1/long-path-long-path"
+	coap2.SetContentFormat(MT_APPLICATION_OCTET_STREAM)
+	coap2.SetMaxAge(100)
+	coap2.SetUriPath("/path1/long-path-long-path")
 	assert(t, coap2, writeAndRead(coap2, t))
 
 }
@@ -149,6 +446,34 @@ func TestCSM(t *testing.T) {
 	assert(t, coap, writeAndRead(coap, t))
 }
 
+func TestAssembleBlock1_limitAndExpiry(t *testing.T) {
+	sc := &serverConn{block1: map[string]*block1Transfer{}, block2: map[string]*block2Transfer{}}
+	firstBlock := func(tag int) *CoapPacket {
+		req := NewCoapPacket(PUT, make([]byte, 16))
+		req.SetUriPath("/upload")
+		req.SetUintOption(OPT_REQUEST_TAG, uint32(tag))
+		req.SetBlock1(Block{0, true, 0})
+		return req
+	}
+
+	for i := 0; i < MAX_BLOCKWISE_TRANSFERS; i++ {
+		if _, resp := sc.assembleBlock1(firstBlock(i)); resp.Code != CODE_231_CONTINUE {
+			t.Fatalf("Unexpected: %v", resp)
+		}
+	}
+	if _, resp := sc.assembleBlock1(firstBlock(MAX_BLOCKWISE_TRANSFERS)); resp.Code != CODE_503_SERVICE_NOT_AVAILABLE {
+		t.Fatalf("Unexpected: %v", resp)
+	}
+
+	//abandoned transfers are discarded
+	for _, transfer := range sc.block1 {
+		transfer.expires = time.Now().Add(-time.Second)
+	}
+	if _, resp := sc.assembleBlock1(firstBlock(MAX_BLOCKWISE_TRANSFERS)); resp.Code != CODE_231_CONTINUE || len(sc.block1) != 1 {
+		t.Fatalf("Unexpected: %v, %d transfers", resp, len(sc.block1))
+	}
+}
+
 func writeAndRead(coap *CoapPacket, t *testing.T) CoapPacket {
 	w := new(bytes.Buffer)
 	if coap.Write(w) != nil {
@@ -173,8 +498,7 @@ func assert(t *testing.T, expectedCoap *CoapPacket, actualCoap CoapPacket) {
 	if !(expectedCoap.Code == actualCoap.Code &&
 		bytes.Equal(expectedCoap.token, actualCoap.token) &&
 		bytes.Equal(expectedCoap.Payload, actualCoap.Payload) &&
-		expectedCoap.UriPath == actualCoap.UriPath &&
-		expectedCoap.MaxAge == actualCoap.MaxAge &&
+		reflect.DeepEqual(expectedCoap.optionsToWrite(), actualCoap.optionsToWrite()) &&
 		reflect.DeepEqual(expectedCoap.CSM, actualCoap.CSM)) {
 
 		t.Errorf("\nExpected: %v \n  Actual: %s", expectedCoap, actualCoap.String())
@@ -0,0 +1,225 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"context"
+	"math/rand"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ReconnectPolicy makes the client connect again, with exponential backoff and jitter,
+// when the connection to the server is lost. Requests wait while the client reconnects.
+type ReconnectPolicy struct {
+	//delay before the first attempt, it doubles with every failed attempt, default is 100ms
+	InitialBackoff time.Duration
+	//default is 30s
+	MaxBackoff time.Duration
+	//the client is closed after so many failed attempts, 0 retries until Close
+	MaxAttempts int
+	//registers observations again on the new connection, otherwise they end
+	Reobserve bool
+	//sends again GET, PUT and DELETE requests that were not answered on the lost connection,
+	//otherwise they fail with ErrConnectionLost
+	ReplayIdempotent bool
+}
+
+// ConnState is reported to Dialer.OnStateChange
+type ConnState int
+
+const (
+	STATE_CONNECTED ConnState = iota
+	STATE_RECONNECTING
+	STATE_CLOSED
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case STATE_CONNECTED:
+		return "connected"
+	case STATE_RECONNECTING:
+		return "reconnecting"
+	case STATE_CLOSED:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// backoff returns delay before attempt, counted from 0. It is a random value between
+// half and full exponential backoff, so that clients disconnected together do not
+// reconnect together.
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	delay, maxDelay := p.InitialBackoff, p.MaxBackoff
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	if maxDelay <= 0 {
+		maxDelay = 30 * time.Second
+	}
+
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// released reconnects to the alternative address, or the same one, after hold-off
+// requested by the server in Release. Requests sent before continue on the released
+// connection until it is closed.
+func (client *CoapClient) released(conn packetConn, release *CoapPacket) {
+	client.mu.Lock()
+	if client.conn != conn || client.reconnecting != nil || client.err != nil {
+		client.mu.Unlock()
+		return
+	}
+	ready := make(chan struct{})
+	client.reconnecting = ready
+	address := client.address
+	client.mu.Unlock()
+
+	if alternatives := release.AlternativeAddresses(); len(alternatives) > 0 {
+		address = alternativeAddress(address, alternatives[0])
+	}
+	client.log.Info("released", "address", address, "hold-off", release.HoldOff())
+	client.stateChanged(STATE_RECONNECTING, ErrConnectionReleased)
+
+	go client.reconnect(ready, address, release.HoldOff())
+}
+
+// reconnect dials address after delay until it succeeds or ReconnectPolicy gives up,
+// without a policy there is a single attempt
+func (client *CoapClient) reconnect(ready chan struct{}, address string, delay time.Duration) {
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-client.closed:
+			return
+		}
+
+		conn, err := client.dial(address)
+		var serverCsm *Capabilities
+		if err == nil {
+			serverCsm, err = client.exchangeCSM(conn)
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			client.reconnected(ready, address, conn, serverCsm)
+			return
+		}
+
+		if client.policy == nil || (client.policy.MaxAttempts > 0 && attempt >= client.policy.MaxAttempts) {
+			client.closeWithError(err)
+			return
+		}
+		delay = client.policy.backoff(attempt)
+		client.log.Warn("reconnect failed", "address", address, "attempt", attempt, "retry", delay, "err", err)
+	}
+}
+
+// reconnected makes conn the current connection and lets waiting requests continue
+func (client *CoapClient) reconnected(ready chan struct{}, address string, conn packetConn, serverCsm *Capabilities) {
+	reobserve := client.policy != nil && client.policy.Reobserve
+
+	client.writeMu.Lock()
+	client.mu.Lock()
+	if client.err != nil {
+		client.mu.Unlock()
+		client.writeMu.Unlock()
+		conn.Close()
+		return
+	}
+	client.conn = conn
+	client.serverCsm = serverCsm
+	client.address = address
+	client.conns[conn] = struct{}{}
+	client.reconnecting = nil
+	observations := client.observations
+	if !reobserve {
+		client.observations = map[string]*Observation{}
+	}
+	client.mu.Unlock()
+	client.writeMu.Unlock()
+
+	client.lastReceived.Store(time.Now().UnixNano())
+	client.log.Info("connected", "peer", conn.RemoteAddr().String())
+	go client.readLoop(conn)
+	close(ready)
+
+	//registrations were made on the previous connection
+	for _, obs := range observations {
+		if !reobserve {
+			obs.end()
+		} else if err := client.writeTo(conn, obs.registration()); err != nil {
+			client.removeObservation(obs)
+		}
+	}
+	client.stateChanged(STATE_CONNECTED, nil)
+}
+
+// replay sends request of a lost exchange again, once the client reconnects
+func (client *CoapClient) replay(key string, exchange *pendingExchange) {
+	conn, err := client.currentConn(context.Background())
+	if err == nil {
+		client.mu.Lock()
+		waiting := client.pending[key] == exchange
+		exchange.conn = conn
+		client.mu.Unlock()
+
+		if !waiting {
+			return
+		}
+		err = client.writeTo(conn, exchange.req)
+	}
+
+	if err != nil {
+		select {
+		case exchange.result <- exchangeResult{nil, err}:
+		default:
+		}
+	}
+}
+
+func (client *CoapClient) stateChanged(state ConnState, err error) {
+	if client.onStateChange != nil {
+		client.onStateChange(state, err)
+	}
+}
+
+func isIdempotent(code uint8) bool {
+	return code == GET || code == PUT || code == DELETE
+}
+
+// alternativeAddress replaces host and port of address, which is a WebSocket uri or host:port
+func alternativeAddress(address string, alternative string) string {
+	u, err := url.Parse(alternative)
+	if err == nil && u.Host != "" && strings.Contains(alternative, "://") {
+		if strings.Contains(address, "://") {
+			return alternative
+		}
+		return u.Host
+	}
+
+	if current, err := url.Parse(address); err == nil && strings.Contains(address, "://") {
+		current.Host = alternative
+		return current.String()
+	}
+	return alternative
+}
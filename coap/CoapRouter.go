@@ -0,0 +1,340 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Router dispatches requests by uri path pattern and method. A pattern is made of segments:
+//   - literal, for example "sensors"
+//   - parameter, for example "{id}", matching exactly one segment
+//   - wildcard, for example "*rest", matching all remaining segments, it must be the last one
+//
+// When several patterns match, the most specific one wins: segments are compared from the
+// left and literal is preferred over parameter, parameter over wildcard.
+type Router struct {
+	routes      []*route
+	middlewares []Middleware
+	//critical options understood by all handlers of the router
+	supported []uint16
+
+	//set on groups, their routes are registered in the parent with the prefix
+	parent *Router
+	prefix string
+}
+
+type route struct {
+	pattern  string
+	segments []patternSegment
+	//handler for any method, used when there is none for the request method
+	any     Handler
+	methods map[uint8]Handler
+}
+
+type patternSegment struct {
+	kind  uint8
+	value string
+}
+
+const (
+	segmentWildcard = 1
+	segmentParam    = 2
+	segmentLiteral  = 3
+)
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers handler for all methods, it panics when the pattern is malformed.
+func (r *Router) Handle(pattern string, handler Handler) {
+	if r.parent != nil {
+		r.parent.Handle(r.groupPattern(pattern), groupHandler{r, handler})
+		return
+	}
+	r.route(pattern).any = handler
+}
+
+func (r *Router) HandleFunc(pattern string, handler func(request *CoapPacket) *CoapPacket) {
+	r.Handle(pattern, HandlerFunc(handler))
+}
+
+// HandleMethod registers handler for a single method, other methods get 4.05 unless
+// handled by Handle with the same pattern.
+func (r *Router) HandleMethod(method uint8, pattern string, handler Handler) {
+	if r.parent != nil {
+		r.parent.HandleMethod(method, r.groupPattern(pattern), groupHandler{r, handler})
+		return
+	}
+	r.route(pattern).methods[method] = handler
+}
+
+// HandleContentFormat registers handler of a single method that responds in contentFormat.
+// Handlers of the same method and pattern are chosen by Accept option, see ContentFormats.
+func (r *Router) HandleContentFormat(method uint8, pattern string, contentFormat int16, handler Handler) {
+	if r.parent != nil {
+		r.parent.HandleContentFormat(method, r.groupPattern(pattern), contentFormat, groupHandler{r, handler})
+		return
+	}
+
+	rt := r.route(pattern)
+	formats, ok := rt.methods[method].(*ContentFormats)
+	if !ok {
+		formats = NewContentFormats()
+		rt.methods[method] = formats
+	}
+	formats.Handle(contentFormat, handler)
+}
+
+// Use appends middlewares that wrap handlers of the router. They run in the order they were
+// added and middlewares of a router run before middlewares of its groups.
+func (r *Router) Use(middlewares ...Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// SupportOptions declares critical options understood by all handlers of the router, for example
+// options processed by a middleware. Requests with other critical options, not known to
+// this library, are answered with 4.02. Single handlers declare options with SupportingOptions.
+func (r *Router) SupportOptions(numbers ...uint16) {
+	r.supported = append(r.supported, numbers...)
+}
+
+// Group returns a router for patterns under prefix, for example Group("/api").Handle("/{id}", h)
+// registers "/api/{id}". Middlewares of a group apply only to handlers registered through it.
+func (r *Router) Group(prefix string) *Router {
+	return &Router{parent: r, prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+func (r *Router) groupPattern(pattern string) string {
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return r.prefix
+	}
+	return r.prefix + "/" + pattern
+}
+
+// groupHandler applies group middlewares, registered handlers are wrapped when served
+// so that Use affects handlers registered before it
+type groupHandler struct {
+	group   *Router
+	handler Handler
+}
+
+func (g groupHandler) Serve(peerIP net.Addr, req *CoapPacket) *CoapPacket {
+	return chain(g.group.middlewares, g.handler).Serve(peerIP, req)
+}
+
+func (g groupHandler) SupportedOptions() []uint16 {
+	return append(append([]uint16{}, g.group.supported...), supportedOptions(g.handler)...)
+}
+
+func (r *Router) route(pattern string) *route {
+	for _, rt := range r.routes {
+		if rt.pattern == pattern {
+			return rt
+		}
+	}
+
+	rt := &route{pattern: pattern, segments: parsePattern(pattern), methods: map[uint8]Handler{}}
+	r.routes = append(r.routes, rt)
+	return rt
+}
+
+func parsePattern(pattern string) []patternSegment {
+	var segments []patternSegment
+	names := map[string]bool{}
+
+	parts := splitPath(pattern)
+	for i, s := range parts {
+		seg := patternSegment{segmentLiteral, s}
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			seg = patternSegment{segmentParam, s[1 : len(s)-1]}
+		} else if strings.HasPrefix(s, "*") {
+			seg = patternSegment{segmentWildcard, s[1:]}
+		}
+
+		if seg.kind != segmentLiteral {
+			if seg.value == "" || names[seg.value] {
+				panic("coap: bad parameter name in pattern " + pattern)
+			}
+			names[seg.value] = true
+		}
+		if seg.kind == segmentWildcard && i != len(parts)-1 {
+			panic("coap: wildcard must be the last segment of pattern " + pattern)
+		}
+		segments = append(segments, seg)
+	}
+	return segments
+}
+
+func splitPath(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// Serve calls handler of the most specific route that matches the request path and method,
+// it responds with 4.04 when no route matches the path and with 4.05 when none allows the method.
+// A request with a critical option not understood by the handler gets 4.02.
+// Router middlewares wrap also 4.02, 4.04 and 4.05 responses.
+func (r *Router) Serve(peerIP net.Addr, req *CoapPacket) *CoapPacket {
+	return chain(r.middlewares, peerHandlerFunc(r.dispatch)).Serve(peerIP, req)
+}
+
+func (r *Router) dispatch(peerIP net.Addr, req *CoapPacket) *CoapPacket {
+	best, handler, params, pathMatched := r.match(req)
+	if resp := r.checkOptions(req, handler); resp != nil {
+		return resp
+	}
+
+	if best == nil && pathMatched {
+		return req.ResponseCode(CODE_405_METHOD_NOT_ALLOWED)
+	}
+	if best == nil {
+		return req.ResponseCode(CODE_404_NOT_FOUND)
+	}
+
+	req.params = params
+	return handler.Serve(peerIP, req)
+}
+
+// match returns the most specific route with a handler of the request method, pathMatched
+// tells whether any route matched the path
+func (r *Router) match(req *CoapPacket) (best *route, handler Handler, params map[string]string, pathMatched bool) {
+	path := splitPath(req.UriPath())
+
+	for _, rt := range r.routes {
+		rtParams, ok := rt.match(path)
+		if !ok {
+			continue
+		}
+		pathMatched = true
+
+		rtHandler := rt.handler(req.Code)
+		if rtHandler != nil && (best == nil || rt.moreSpecific(best)) {
+			best, handler, params = rt, rtHandler, rtParams
+		}
+	}
+	return best, handler, params, pathMatched
+}
+
+// checkOptions returns 4.02 response when the request has critical options not understood
+// by the router or handler, otherwise nil. Handler is nil when no route matches the request.
+func (r *Router) checkOptions(req *CoapPacket, handler Handler) *CoapPacket {
+	unrecognized := req.UnrecognizedOptions(r.supported...)
+	if len(unrecognized) > 0 && handler != nil {
+		supported := append(append([]uint16{}, r.supported...), supportedOptions(handler)...)
+		unrecognized = req.UnrecognizedOptions(supported...)
+	}
+	if len(unrecognized) > 0 {
+		return badOption(req, unrecognized)
+	}
+	return nil
+}
+
+// badOptionResponse returns 4.02 response that Serve would return for the request, without
+// calling handlers or middlewares, otherwise nil
+func (r *Router) badOptionResponse(req *CoapPacket) *CoapPacket {
+	_, handler, _, _ := r.match(req)
+	return r.checkOptions(req, handler)
+}
+
+func (rt *route) handler(method uint8) Handler {
+	if handler, ok := rt.methods[method]; ok {
+		return handler
+	}
+	return rt.any
+}
+
+func (rt *route) match(path []string) (map[string]string, bool) {
+	params := map[string]string{}
+
+	for i, seg := range rt.segments {
+		if seg.kind == segmentWildcard {
+			params[seg.value] = strings.Join(path[i:], "/")
+			return params, true
+		}
+		if i >= len(path) {
+			return nil, false
+		}
+
+		switch seg.kind {
+		case segmentLiteral:
+			if seg.value != path[i] {
+				return nil, false
+			}
+		case segmentParam:
+			params[seg.value] = path[i]
+		}
+	}
+	return params, len(rt.segments) == len(path)
+}
+
+func (rt *route) moreSpecific(other *route) bool {
+	for i := 0; i < len(rt.segments) && i < len(other.segments); i++ {
+		if rt.segments[i].kind != other.segments[i].kind {
+			return rt.segments[i].kind > other.segments[i].kind
+		}
+	}
+	//the longer one ends with a wildcard matching nothing
+	return len(rt.segments) < len(other.segments)
+}
+
+// OptionSupporter is implemented by handlers that understand critical options not known to this library
+type OptionSupporter interface {
+	SupportedOptions() []uint16
+}
+
+// SupportingOptions declares critical options understood by handler, so that requests
+// with them are not rejected with 4.02
+func SupportingOptions(handler Handler, numbers ...uint16) Handler {
+	return optionsHandler{handler, numbers}
+}
+
+type optionsHandler struct {
+	Handler
+	numbers []uint16
+}
+
+func (h optionsHandler) SupportedOptions() []uint16 {
+	return append(append([]uint16{}, h.numbers...), supportedOptions(h.Handler)...)
+}
+
+func supportedOptions(handler Handler) []uint16 {
+	if supporter, ok := handler.(OptionSupporter); ok {
+		return supporter.SupportedOptions()
+	}
+	return nil
+}
+
+// badOption responds to a request with unrecognized critical options
+// https://tools.ietf.org/html/rfc7252#section-5.4.1
+func badOption(req *CoapPacket, unrecognized []uint16) *CoapPacket {
+	numbers := make([]string, len(unrecognized))
+	for i, number := range unrecognized {
+		numbers[i] = fmt.Sprint(number)
+	}
+	return req.Response(CODE_402_BAD_OPTION, -1, []byte("unrecognized critical option "+strings.Join(numbers, ", ")))
+}
+
+// PathParam returns value of a pattern parameter or wildcard matched by Router, for example
+// "17" for parameter "id" of pattern "/sensors/{id}/temp" and request "/sensors/17/temp".
+func (p *CoapPacket) PathParam(name string) string {
+	return p.params[name]
+}
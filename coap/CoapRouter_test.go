@@ -0,0 +1,255 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouter(t *testing.T) {
+	router := NewRouter()
+	handler := func(name string) Handler {
+		return HandlerFunc(func(req *CoapPacket) *CoapPacket {
+			return req.ResponseText(CODE_205_CONTENT, name+" "+req.PathParam("id")+" "+req.PathParam("rest"))
+		})
+	}
+	router.Handle("/sensors/{id}/temp", handler("temp"))
+	router.Handle("/sensors/main/temp", handler("main"))
+	router.Handle("/sensors/*rest", handler("any"))
+	router.HandleMethod(PUT, "/fw/*rest", handler("fw"))
+	router.HandleMethod(GET, "/fw", handler("fw-list"))
+	router.Handle("/", handler("root"))
+
+	tests := []struct {
+		method  uint8
+		path    string
+		code    uint8
+		payload string
+	}{
+		{GET, "/sensors/17/temp", CODE_205_CONTENT, "temp 17 "},
+		{GET, "/sensors/main/temp", CODE_205_CONTENT, "main  "},
+		{GET, "/sensors/17/humidity", CODE_205_CONTENT, "any  17/humidity"},
+		{GET, "/sensors", CODE_205_CONTENT, "any  "},
+		{PUT, "/fw/v1/image", CODE_205_CONTENT, "fw  v1/image"},
+		{GET, "/fw/v1/image", CODE_405_METHOD_NOT_ALLOWED, ""},
+		{GET, "/fw", CODE_205_CONTENT, "fw-list  "},
+		{PUT, "/fw", CODE_205_CONTENT, "fw  "},
+		{DELETE, "/fw", CODE_405_METHOD_NOT_ALLOWED, ""},
+		{GET, "", CODE_205_CONTENT, "root  "},
+		{GET, "/other", CODE_404_NOT_FOUND, ""},
+	}
+
+	for _, test := range tests {
+		req := NewCoapPacket(test.method, []byte{})
+		req.SetUriPath(test.path)
+
+		resp := router.Serve(nil, req)
+		if resp.Code != test.code || string(resp.Payload) != test.payload {
+			t.Errorf("%s %s\nExpected: %d %q\n  Actual: %d %q", req.StringCode(), test.path, test.code, test.payload, resp.Code, resp.Payload)
+		}
+	}
+}
+
+func TestRouter_malformedPattern(t *testing.T) {
+	for _, pattern := range []string{"/a/*rest/b", "/a/{}", "/{id}/{id}", "/*"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected panic for %s", pattern)
+				}
+			}()
+			NewRouter().Handle(pattern, nil)
+		}()
+	}
+}
+
+func TestRouter_middlewares(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(req *CoapPacket) *CoapPacket {
+				calls = append(calls, name)
+				return next.Serve(nil, req)
+			})
+		}
+	}
+
+	router := NewRouter()
+	router.Use(trace("first"), trace("second"))
+	router.HandleFunc("/open", func(req *CoapPacket) *CoapPacket {
+		return req.ResponseCode(CODE_205_CONTENT)
+	})
+
+	api := router.Group("/api")
+	api.HandleFunc("/{id}", func(req *CoapPacket) *CoapPacket {
+		return req.ResponseText(CODE_205_CONTENT, req.PathParam("id"))
+	})
+	//added after the handler, still applies
+	api.Use(trace("api"))
+
+	tests := []struct {
+		path  string
+		code  uint8
+		calls string
+	}{
+		{"/api/7", CODE_205_CONTENT, "first,second,api"},
+		{"/open", CODE_205_CONTENT, "first,second"},
+		{"/missing", CODE_404_NOT_FOUND, "first,second"},
+	}
+	for _, test := range tests {
+		calls = nil
+		req := NewCoapPacket(GET, []byte{})
+		req.SetUriPath(test.path)
+
+		resp := router.Serve(nil, req)
+		if resp.Code != test.code || strings.Join(calls, ",") != test.calls {
+			t.Errorf("%s\nExpected: %d %s\n  Actual: %d %s", test.path, test.code, test.calls, resp.Code, strings.Join(calls, ","))
+		}
+	}
+}
+
+func TestRouter_contentFormats(t *testing.T) {
+	router := NewRouter()
+	router.HandleContentFormat(GET, "/temp", MT_TEXT_PLAIN, HandlerFunc(func(req *CoapPacket) *CoapPacket {
+		return req.Response(CODE_205_CONTENT, -1, []byte("21.5"))
+	}))
+	router.HandleContentFormat(GET, "/temp", MT_APPLICATION_JSON, HandlerFunc(func(req *CoapPacket) *CoapPacket {
+		return req.Response(CODE_205_CONTENT, -1, []byte(`{"temp":21.5}`))
+	}))
+
+	tests := []struct {
+		method        uint8
+		accept        int16
+		code          uint8
+		contentFormat int16
+	}{
+		{GET, -1, CODE_205_CONTENT, MT_TEXT_PLAIN},
+		{GET, MT_APPLICATION_JSON, CODE_205_CONTENT, MT_APPLICATION_JSON},
+		{GET, MT_APPLICATION_CBOR, CODE_406_NOT_ACCEPTABLE, -1},
+		{PUT, MT_TEXT_PLAIN, CODE_405_METHOD_NOT_ALLOWED, -1},
+	}
+	for _, test := range tests {
+		req := NewCoapPacket(test.method, []byte{})
+		req.SetUriPath("/temp")
+		req.SetAccept(test.accept)
+
+		resp := router.Serve(nil, req)
+		if resp.Code != test.code || resp.ContentFormat() != test.contentFormat {
+			t.Errorf("Accept %d\nExpected: %d %d\n  Actual: %d %d", test.accept, test.code, test.contentFormat, resp.Code, resp.ContentFormat())
+		}
+	}
+}
+
+func TestNotAcceptable(t *testing.T) {
+	req := NewCoapPacket(GET, []byte{})
+	req.SetAccept(MT_APPLICATION_JSON)
+
+	if resp := notAcceptable(req, req.ResponseText(CODE_205_CONTENT, "text")); resp.Code != CODE_406_NOT_ACCEPTABLE {
+		t.Errorf("Unexpected: %v", resp)
+	}
+	if resp := notAcceptable(req, req.ResponseText(CODE_404_NOT_FOUND, "text")); resp.Code != CODE_404_NOT_FOUND {
+		t.Errorf("Unexpected: %v", resp)
+	}
+}
+
+func TestRouter_criticalOptions(t *testing.T) {
+	const optCustom = 2049
+	const optTraced = 2051
+	ok := HandlerFunc(func(req *CoapPacket) *CoapPacket {
+		return req.ResponseCode(CODE_205_CONTENT)
+	})
+
+	router := NewRouter()
+	router.Handle("/plain", ok)
+	router.Handle("/custom", SupportingOptions(ok, optCustom))
+	router.Handle("/conditional", Conditional(ok, nil, func(req *CoapPacket) ([]byte, bool) {
+		return []byte{1}, true
+	}))
+	traced := router.Group("/traced")
+	traced.SupportOptions(optTraced)
+	traced.Handle("/a", ok)
+
+	tests := []struct {
+		path    string
+		options []uint16
+		code    uint8
+		payload string
+	}{
+		{"/plain", []uint16{2048, 2050}, CODE_205_CONTENT, ""},
+		{"/plain", []uint16{optCustom, optCustom, optTraced}, CODE_402_BAD_OPTION, "unrecognized critical option 2049, 2051"},
+		{"/custom", []uint16{optCustom}, CODE_205_CONTENT, ""},
+		{"/custom", []uint16{optCustom, optTraced}, CODE_402_BAD_OPTION, "unrecognized critical option 2051"},
+		{"/missing", []uint16{optCustom}, CODE_402_BAD_OPTION, "unrecognized critical option 2049"},
+		{"/plain", []uint16{OPT_IF_MATCH, OPT_URI_HOST, OPT_URI_PORT}, CODE_402_BAD_OPTION, "unrecognized critical option 1"},
+		{"/conditional", []uint16{OPT_IF_MATCH, OPT_IF_NONE_MATCH}, CODE_412_PRECONDITION_FAILED, ""},
+		{"/conditional", []uint16{OPT_IF_MATCH}, CODE_205_CONTENT, ""},
+	}
+	for _, test := range tests {
+		req := NewCoapPacket(GET, []byte{})
+		req.SetUriPath(test.path)
+		for _, number := range test.options {
+			req.AddOption(number, []byte{})
+		}
+
+		resp := router.Serve(nil, req)
+		if resp.Code != test.code || string(resp.Payload) != test.payload {
+			t.Errorf("%s %v\nExpected: %d %q\n  Actual: %d %q", test.path, test.options, test.code, test.payload, resp.Code, resp.Payload)
+		}
+	}
+
+	//group declares options for its handlers only
+	req := NewCoapPacket(GET, []byte{})
+	req.SetUriPath("/traced/a")
+	req.AddOption(optTraced, []byte{})
+	if resp := router.Serve(nil, req); resp.Code != CODE_205_CONTENT {
+		t.Errorf("Unexpected: %v", resp)
+	}
+}
+
+func TestRecoveryAndTiming(t *testing.T) {
+	var timed *CoapPacket
+	handler := chain([]Middleware{
+		Timing(func(req *CoapPacket, resp *CoapPacket, duration time.Duration) {
+			timed = resp
+		}),
+		Recovery,
+	}, HandlerFunc(func(req *CoapPacket) *CoapPacket {
+		panic("handler failure")
+	}))
+
+	req := NewCoapPacket(GET, []byte{})
+	req.token = []byte{0x01}
+	resp := handler.Serve(&net.TCPAddr{}, req)
+
+	if resp.Code != CODE_500_INTERNAL_SERVER_ERROR || timed != resp || resp.token[0] != 0x01 {
+		t.Errorf("Unexpected: %v", resp)
+	}
+}
+
+func TestRecoveryWithLogger(t *testing.T) {
+	logs := &bytes.Buffer{}
+	handler := RecoveryWithLogger(slog.New(slog.NewTextHandler(logs, nil)))(HandlerFunc(func(req *CoapPacket) *CoapPacket {
+		panic("handler failure")
+	}))
+
+	resp := handler.Serve(&net.TCPAddr{}, NewCoapPacket(GET, []byte{}))
+	if resp.Code != CODE_500_INTERNAL_SERVER_ERROR || !strings.Contains(logs.String(), `panic="handler failure"`) {
+		t.Errorf("Unexpected: %v\n%s", resp, logs)
+	}
+}
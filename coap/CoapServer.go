@@ -14,15 +14,39 @@ limitations under the License.
 package coap
 
 import (
-	"bufio"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
 	"net"
+	"sync"
 )
 
 type CoapServer struct {
-	l        net.Listener
-	handlers map[string]Handler
-	csm      *Capabilities
+	router *Router
+	csm    *Capabilities
+	state  *serverState
+	log    *slog.Logger
+	//requests served at the same time on a single connection
+	maxConcurrentRequests int
+}
+
+const DEFAULT_MAX_CONCURRENT_REQUESTS = 16
+
+// ErrServerClosed is returned by Start after Shutdown
+var ErrServerClosed = errors.New("coap: server closed")
+
+var errReleasedByPeer = errors.New("coap: connection released by peer")
+
+// serverState tracks listeners and connections, it is shared by copies of CoapServer
+type serverState struct {
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+	shutdown  bool
+
+	//requests being served and responded
+	inFlight sync.WaitGroup
 }
 
 type Handler interface {
@@ -34,49 +58,175 @@ func NewCoapServer() CoapServer {
 }
 
 func NewCoapServerWithCSM(csm *Capabilities) CoapServer {
-	return CoapServer{handlers: map[string]Handler{}, csm: csm}
+	state := &serverState{listeners: map[net.Listener]struct{}{}, conns: map[*serverConn]struct{}{}}
+	return CoapServer{router: NewRouter(), csm: csm, state: state, log: loggerOrDiscard(nil), maxConcurrentRequests: DEFAULT_MAX_CONCURRENT_REQUESTS}
+}
+
+// SetLogger enables logging, nil disables it
+func (server *CoapServer) SetLogger(logger *slog.Logger) {
+	server.log = loggerOrDiscard(logger)
+}
+
+// SetMaxConcurrentRequests limits requests served at the same time on a single connection.
+// Further requests wait, responses and signals are still received meanwhile.
+// Limit 1 serves requests one by one.
+// Handlers must be safe for concurrent use when the limit is greater than 1.
+func (server *CoapServer) SetMaxConcurrentRequests(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	server.maxConcurrentRequests = limit
 }
 
 func (server *CoapServer) Start(address string, c chan bool) error {
 	l, err := net.Listen("tcp4", address)
 	if err != nil {
-		fmt.Println(err)
+		server.log.Error("listen failed", "addr", address, "err", err)
 		if c != nil {
 			c <- false
 		}
 		return err
 	}
-	server.l = l
+	return server.serve(l, c)
+}
 
-	fmt.Printf("CoapServer listening on %v\n", l.Addr())
+// StartTLS listens for coaps+tcp connections, ALPN protocol "coap" is added to the config
+// https://tools.ietf.org/html/rfc8323#section-3.4
+func (server *CoapServer) StartTLS(address string, config *tls.Config, c chan bool) error {
+	l, err := net.Listen("tcp4", address)
+	if err != nil {
+		server.log.Error("listen failed", "addr", address, "err", err)
+		if c != nil {
+			c <- false
+		}
+		return err
+	}
+	return server.serve(tls.NewListener(l, withAlpn(config)), c)
+}
+
+func (server *CoapServer) serve(l net.Listener, c chan bool) error {
+	if !server.state.addListener(l) {
+		l.Close()
+		if c != nil {
+			c <- false
+		}
+		return ErrServerClosed
+	}
+
+	server.log.Info("listening", "addr", l.Addr().String())
 
 	if c != nil {
 		c <- true
 	}
-	defer server.l.Close()
+	defer server.state.removeListener(l)
 	for {
-		c, err := server.l.Accept()
+		c, err := l.Accept()
 		if err != nil {
-			fmt.Println(err)
+			if server.state.isShutdown() {
+				return ErrServerClosed
+			}
+			server.log.Error("accept failed", "addr", l.Addr().String(), "err", err)
 			return err
 		} else {
 			go server.handleConnection(c)
 		}
 	}
-
-	return nil
 }
 
+// Stop closes listeners, established connections are not closed
 func (server CoapServer) Stop() error {
-	return server.l.Close()
+	var err error
+	for _, l := range server.state.listenerList() {
+		if closeErr := l.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Shutdown gracefully stops the server, see ShutdownWithRelease
+func (server *CoapServer) Shutdown(ctx context.Context) error {
+	return server.ShutdownWithRelease(ctx, NewRelease("", 0))
+}
+
+// ShutdownWithRelease stops accepting connections and sends release signal to every peer,
+// created with NewRelease. Requests received after that are answered with 5.03.
+// When requests being served are responded or ctx is done, connections are closed.
+func (server *CoapServer) ShutdownWithRelease(ctx context.Context, release *CoapPacket) error {
+	state := server.state
+
+	state.mu.Lock()
+	state.shutdown = true
+	conns := make([]*serverConn, 0, len(state.conns))
+	for sc := range state.conns {
+		conns = append(conns, sc)
+	}
+	state.mu.Unlock()
+
+	server.Stop()
+
+	for _, sc := range conns {
+		if err := sc.write(release); err != nil {
+			sc.log.Warn("release not sent", "err", err)
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		state.inFlight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	for _, sc := range conns {
+		sc.conn.Close()
+	}
+	return err
+}
+
+// Sessions returns connections of clients, they can be used to send requests to the clients
+func (server *CoapServer) Sessions() []*Session {
+	return server.state.sessions()
 }
 
+// Handle registers handler for all methods, uriPath may be a Router pattern, for example "/sensors/{id}/temp"
 func (server *CoapServer) Handle(uriPath string, handler Handler) {
-	server.handlers[uriPath] = handler
+	server.router.Handle(uriPath, handler)
 }
 
 func (server *CoapServer) HandleFunc(uriPath string, handler func(request *CoapPacket) *CoapPacket) {
-	server.handlers[uriPath] = HandlerFunc(handler)
+	server.router.Handle(uriPath, HandlerFunc(handler))
+}
+
+// HandleMethod registers handler for a single method, other methods are answered with 4.05
+func (server *CoapServer) HandleMethod(method uint8, uriPath string, handler Handler) {
+	server.router.HandleMethod(method, uriPath, handler)
+}
+
+// SupportOptions declares critical options understood by all handlers, see Router.SupportOptions
+func (server *CoapServer) SupportOptions(numbers ...uint16) {
+	server.router.SupportOptions(numbers...)
+}
+
+// HandleContentFormat registers handler of a method for one content format, it is chosen by Accept option
+func (server *CoapServer) HandleContentFormat(method uint8, uriPath string, contentFormat int16, handler Handler) {
+	server.router.HandleContentFormat(method, uriPath, contentFormat, handler)
+}
+
+// Use adds middlewares wrapping all handlers, the first one added runs first
+func (server *CoapServer) Use(middlewares ...Middleware) {
+	server.router.Use(middlewares...)
+}
+
+// Group returns a router for handlers under prefix with their own middlewares
+func (server *CoapServer) Group(prefix string) *Router {
+	return server.router.Group(prefix)
 }
 
 type HandlerFunc func(request *CoapPacket) *CoapPacket
@@ -86,7 +236,19 @@ func (f HandlerFunc) Serve(peerIP net.Addr, packet *CoapPacket) *CoapPacket {
 }
 
 func (server *CoapServer) HandleGet(uriPath string, handler func(request *CoapPacket) *CoapPacket) {
-	server.handlers[uriPath] = HandlerGetFunc(handler)
+	server.router.HandleMethod(GET, uriPath, HandlerFunc(handler))
+}
+
+func (server *CoapServer) HandlePost(uriPath string, handler func(request *CoapPacket) *CoapPacket) {
+	server.router.HandleMethod(POST, uriPath, HandlerFunc(handler))
+}
+
+func (server *CoapServer) HandlePut(uriPath string, handler func(request *CoapPacket) *CoapPacket) {
+	server.router.HandleMethod(PUT, uriPath, HandlerFunc(handler))
+}
+
+func (server *CoapServer) HandleDelete(uriPath string, handler func(request *CoapPacket) *CoapPacket) {
+	server.router.HandleMethod(DELETE, uriPath, HandlerFunc(handler))
 }
 
 type HandlerGetFunc func(request *CoapPacket) *CoapPacket
@@ -99,75 +261,419 @@ func (f HandlerGetFunc) Serve(peerIP net.Addr, req *CoapPacket) *CoapPacket {
 }
 
 func (server *CoapServer) handleConnection(c net.Conn) {
-	fmt.Printf("%v Connected\n", c.RemoteAddr())
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			server.log.Warn("TLS handshake failed", "peer", c.RemoteAddr().String(), "err", err)
+			c.Close()
+			return
+		}
+	}
+
+	server.serveConn(newTcpConn(c))
+}
+
+// serveConn exchanges CSM and serves requests until the connection fails
+func (server *CoapServer) serveConn(c packetConn) {
+	log := server.log.With("peer", c.RemoteAddr().String())
+	log.Info("connected")
 	defer c.Close()
-	reader := bufio.NewReader(c)
-	//clientCapabilities := Capabilities{1152, false}
+
+	sc := &serverConn{
+		conn: c,
+		log:  log,
+		csm:  server.csm,
+		//defaults until client CSM, https://tools.ietf.org/html/rfc8323#section-5.3.1
+		peerCsm:   &Capabilities{1152, false},
+		observers: map[string]*Observer{},
+		block1:    map[string]*block1Transfer{},
+		block2:    map[string]*block2Transfer{},
+		requests:  make(chan struct{}, server.maxConcurrentRequests),
+		serving:   map[chan struct{}]struct{}{},
+		pending:   map[string]chan *CoapPacket{},
+		closed:    make(chan struct{}),
+	}
+	sc.session = newSession(sc)
+
+	//registered before the client can complete CSM exchange, so that it gets release
+	//on shutdown, server CSM is sent first because writes are serialized
+	sc.writeMu.Lock()
+	if !server.state.addConn(sc) {
+		sc.writeMu.Unlock()
+		log.Info("disconnected", "err", ErrServerClosed)
+		return
+	}
+	defer server.state.removeConn(sc)
+	defer sc.removeObservers()
+	defer func() {
+		c.Close()
+		close(sc.closed)
+		sc.handlers.Wait()
+	}()
 
 	//send server capabilities
 	coapCSM := NewCoapPacket(CODE_701_CSM, []byte{})
 	coapCSM.CSM = server.csm
 
-	err := coapCSM.Write(c)
+	err := c.writePacket(coapCSM, 0)
+	sc.writeMu.Unlock()
 	if err != nil {
-		fmt.Printf("%v Disconecting: %s\n", c.RemoteAddr(), err)
+		log.Info("disconnected", "err", err)
 		return
 	}
-	fmt.Printf("%v Sent %v\n", c.RemoteAddr(), coapCSM)
+	logPacket(log, "sent", coapCSM)
 
 	//wait for client CSM
-	clientCSM, err := ReadCoap(reader)
+	clientCSM, err := c.readPacket(server.csm.MaxMessageSize)
 	if err != nil {
-		fmt.Printf("Disconecting %v - %s\n", c.RemoteAddr(), err)
+		log.Info("disconnected", "err", err)
+		sc.writeMu.Lock()
+		abortOnProtocolError(c, err, log)
+		sc.writeMu.Unlock()
 		return
 	}
 
-	fmt.Printf("%v Received %v\n", c.RemoteAddr(), clientCSM)
+	logPacket(log, "received", clientCSM)
 	if clientCSM.Code != CODE_701_CSM || clientCSM.CSM == nil {
+		sc.writeMu.Lock()
+		abortOnProtocolError(c, &MessageFormatError{"expected CSM"}, log)
+		sc.writeMu.Unlock()
 		return
 	}
+	sc.writeMu.Lock()
+	sc.peerCsm = clientCSM.CSM
+	sc.writeMu.Unlock()
 
 	for {
-		req, err := ReadCoap(reader)
+		req, err := c.readPacket(server.csm.MaxMessageSize)
+		if tooLarge := requestTooLarge(req, err); tooLarge != nil {
+			logPacket(log, "received too large", req)
+			err = sc.respond(req, tooLarge)
+		} else if err != nil {
+			log.Info("disconnected", "err", err)
+			sc.writeMu.Lock()
+			abortOnProtocolError(c, err, log)
+			sc.writeMu.Unlock()
+			return
+		} else if isRequest(req.Code) {
+			logPacket(log, "received", req)
+			server.handleConcurrently(sc, req, server.state.beginRequest())
+		} else {
+			logPacket(log, "received", req)
+			err = server.handleMessage(sc, req, false)
+		}
+
 		if err != nil {
-			fmt.Printf("%v Disconecting: %s\n", c.RemoteAddr(), err)
+			log.Info("disconnected", "err", err)
 			return
 		}
+	}
+}
 
-		fmt.Printf("%v Received %v\n", c.RemoteAddr(), req)
+// serverConn holds state of a single client connection
+type serverConn struct {
+	conn    packetConn
+	log     *slog.Logger
+	csm     *Capabilities
+	peerCsm *Capabilities
+	writeMu sync.Mutex
+
+	//limits requests served concurrently
+	requests chan struct{}
+	handlers sync.WaitGroup
+	//closed when a request being served is responded
+	serving map[chan struct{}]struct{}
+
+	mu        sync.Mutex
+	observers map[string]*Observer
+	//block-wise transfers in progress, by blockKey of the request
+	block1 map[string]*block1Transfer
+	block2 map[string]*block2Transfer
+
+	//requests sent to the client with Session, waiting for response
+	session   *Session
+	lastToken uint32
+	pending   map[string]chan *CoapPacket
+	closed    chan struct{}
+}
 
-		resp, err := server.serveRequest(c.RemoteAddr(), req)
+func (sc *serverConn) write(packet *CoapPacket) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
 
-		if resp != nil {
-			err = resp.Write(c)
+	err := sc.conn.writePacket(packet, sc.peerCsm.MaxMessageSize)
+	if err == nil {
+		logPacket(sc.log, "sent", packet)
+	}
+	return err
+}
+
+// respond writes response, replacing it with 5.00 when it exceeds peer's Max-Message-Size
+func (sc *serverConn) respond(req *CoapPacket, resp *CoapPacket) error {
+	err := sc.write(resp)
+
+	var tooLarge *MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+		sc.log.Warn("response not sent", "code", resp.StringCode(), "err", err)
+		resp = req.ResponseCode(CODE_500_INTERNAL_SERVER_ERROR)
+		resp.Payload = []byte("response too large")
+		err = sc.write(resp)
+	}
+
+	if req.observer != nil {
+		close(req.observer.ready)
+	}
+	return err
+}
+
+// requestTooLarge returns 4.13 response when err reports a request exceeding our Max-Message-Size
+func requestTooLarge(req *CoapPacket, err error) *CoapPacket {
+	var tooLarge *MessageTooLargeError
+	if !errors.As(err, &tooLarge) || !isRequest(req.Code) {
+		return nil
+	}
+
+	resp := req.ResponseCode(CODE_413_REQUEST_ENTITY_TOO_LARGE)
+	resp.SetUintOption(OPT_SIZE1, tooLarge.MaxSize)
+	return resp
+}
+
+// abortOnProtocolError sends Abort signal when err is caused by a malformed message
+func abortOnProtocolError(c packetConn, err error, log *slog.Logger) {
+	var protocolErr protocolError
+	if !errors.As(err, &protocolErr) {
+		return
+	}
+
+	abort := protocolErr.abort()
+	if c.writePacket(abort, 0) == nil {
+		log.Warn("sent abort", "err", err)
+	}
+}
+
+// handleConcurrently serves request in a new goroutine, it waits there while the connection
+// has the maximum number of requests in progress, so that the connection keeps reading
+// responses to requests of handlers and signals
+func (server *CoapServer) handleConcurrently(sc *serverConn, req *CoapPacket, tracked bool) {
+	sc.handlers.Add(1)
+	done := make(chan struct{})
+	sc.mu.Lock()
+	sc.serving[done] = struct{}{}
+	sc.mu.Unlock()
+
+	go func() {
+		defer func() {
+			sc.mu.Lock()
+			delete(sc.serving, done)
+			sc.mu.Unlock()
+			close(done)
+			<-sc.requests
+			sc.handlers.Done()
+		}()
+
+		sc.requests <- struct{}{}
+		if err := server.handleMessage(sc, req, tracked); err != nil {
+			sc.log.Info("disconnected", "err", err)
+			sc.conn.Close()
 		}
-		if err != nil {
-			fmt.Printf("%v Disconecting: %s\n", c.RemoteAddr(), err)
-			return
+	}()
+}
+
+// afterServed calls f in a new goroutine, once requests being served are responded.
+// The connection keeps reading meanwhile, handlers may wait for responses to their requests.
+func (sc *serverConn) afterServed(f func()) {
+	sc.mu.Lock()
+	serving := make([]chan struct{}, 0, len(sc.serving))
+	for done := range sc.serving {
+		serving = append(serving, done)
+	}
+	sc.mu.Unlock()
+
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		for _, done := range serving {
+			<-done
 		}
-		fmt.Printf("%v Sent %v\n", c.RemoteAddr(), coapCSM)
+		f()
+	}()
+}
+
+// handleMessage serves a message and writes the response. Requests received during shutdown,
+// not tracked as in flight, get 5.03.
+func (server *CoapServer) handleMessage(sc *serverConn, req *CoapPacket, tracked bool) error {
+	if tracked {
+		defer server.state.inFlight.Done()
+	}
+
+	var resp *CoapPacket
+	var err error
+	if !tracked && isRequest(req.Code) {
+		resp = req.ResponseText(CODE_503_SERVICE_NOT_AVAILABLE, "shutting down")
+	} else {
+		resp, err = server.serveRequest(sc, req)
+	}
 
+	if resp != nil && err == nil {
+		err = sc.respond(req, resp)
 	}
+	return err
 }
 
-func (server *CoapServer) serveRequest(addr net.Addr, req *CoapPacket) (*CoapPacket, error) {
-	//ping
+func (server *CoapServer) serveRequest(sc *serverConn, req *CoapPacket) (*CoapPacket, error) {
+	//ping, with custody it is answered after responses to requests received before it
 	if req.Code == CODE_702_PING {
-		return req.ResponseCode(CODE_703_PONG), nil
+		pong := req.ResponseCode(CODE_703_PONG)
+		if !req.HasOption(OPT_PING_CUSTODY) {
+			return pong, nil
+		}
+
+		pong.AddOption(OPT_PING_CUSTODY, []byte{})
+		sc.afterServed(func() {
+			if err := sc.respond(req, pong); err != nil {
+				sc.log.Info("disconnected", "err", err)
+				sc.conn.Close()
+			}
+		})
+		return nil, nil
+	}
+
+	//csm update
+	if req.Code == CODE_701_CSM {
+		sc.writeMu.Lock()
+		sc.peerCsm = req.CSM
+		sc.writeMu.Unlock()
+		return nil, nil
+	}
+
+	//the client is going away, let requests in progress be answered first
+	if req.Code == CODE_704_RELEASE {
+		sc.afterServed(func() {
+			sc.log.Info("disconnected", "err", errReleasedByPeer)
+			sc.conn.Close()
+		})
+		return nil, nil
+	}
+
+	if req.Code == CODE_705_ABORT {
+		badOption, _ := req.BadCSMOption()
+		return nil, &AbortError{string(req.Payload), badOption}
+	}
+
+	//response to a request sent with Session
+	if isResponse(req.Code) || req.Code == CODE_703_PONG {
+		sc.deliver(req)
+		return nil, nil
 	}
 
 	//request
 	if req.Code > 0 && req.Code <= 4 {
-		handler, exists := server.handlers[req.UriPath]
-
-		var resp *CoapPacket
-		if exists {
-			resp = handler.Serve(addr, req)
-		} else {
-			resp = req.ResponseCode(CODE_404_NOT_FOUND)
+		if resp := sc.cachedBlock2(req); resp != nil {
+			return resp, nil
+		}
+		//not buffered when the whole request would be rejected
+		if block1, ok := req.Block1(); ok && block1.Num == 0 {
+			if resp := server.router.badOptionResponse(req); resp != nil {
+				return resp, nil
+			}
+		}
+		fullReq, resp := sc.assembleBlock1(req)
+		if resp != nil {
+			return resp, nil
 		}
 
-		return resp, nil
+		fullReq.session = sc.session
+		sc.prepareObserve(fullReq)
+		resp = notAcceptable(fullReq, server.router.Serve(sc.conn.RemoteAddr(), fullReq))
+
+		//observation ends when the final response is not 2.xx
+		sc.registerObserver(fullReq, resp)
+		if resp == nil {
+			return nil, nil
+		}
+		resp = notModified(fullReq, resp)
+		if block1, ok := req.Block1(); ok {
+			resp.SetBlock1(block1)
+		}
+		return sc.block2Response(fullReq, resp), nil
 	}
 	return nil, nil
 }
+
+//------ server state ----------
+
+func (s *serverState) addListener(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *serverState) removeListener(l net.Listener) {
+	s.mu.Lock()
+	delete(s.listeners, l)
+	s.mu.Unlock()
+
+	l.Close()
+}
+
+func (s *serverState) listenerList() []net.Listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	listeners := make([]net.Listener, 0, len(s.listeners))
+	for l := range s.listeners {
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+func (s *serverState) addConn(sc *serverConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+	s.conns[sc] = struct{}{}
+	return true
+}
+
+func (s *serverState) removeConn(sc *serverConn) {
+	s.mu.Lock()
+	delete(s.conns, sc)
+	s.mu.Unlock()
+}
+
+func (s *serverState) sessions() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make([]*Session, 0, len(s.conns))
+	for sc := range s.conns {
+		sessions = append(sessions, sc.session)
+	}
+	return sessions
+}
+
+func (s *serverState) isShutdown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.shutdown
+}
+
+// beginRequest counts a request as in flight, unless the server is shutting down
+func (s *serverState) beginRequest() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+	s.inFlight.Add(1)
+	return true
+}
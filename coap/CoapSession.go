@@ -0,0 +1,213 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// CoAP over TCP is symmetric, once connected both ends can send requests and serve them.
+// https://tools.ietf.org/html/rfc8323#section-3.2
+
+var ErrSessionClosed = errors.New("coap: session closed")
+
+// Peer is an end of a connection that requests can be sent to. It is implemented by
+// CoapClient, for requests to the server, and by Session, for requests to a client.
+type Peer interface {
+	RemoteAddr() net.Addr
+	InvokeCoapContext(ctx context.Context, req *CoapPacket) (*CoapPacket, error)
+	Close() error
+}
+
+var _ Peer = (*CoapClient)(nil)
+var _ Peer = (*Session)(nil)
+
+//------ server ----------
+
+// Session is a connection of a client to CoapServer, handlers get it with CoapPacket.Session.
+// The server can send requests over it, for example commands to devices that connected
+// from behind NAT. Requests are sent in a single message, without block-wise transfer.
+type Session struct {
+	sc *serverConn
+	id uint64
+
+	mu         sync.Mutex
+	attributes map[string]any
+}
+
+var lastSessionID atomic.Uint64
+
+func newSession(sc *serverConn) *Session {
+	return &Session{sc: sc, id: lastSessionID.Add(1), attributes: map[string]any{}}
+}
+
+// Session returns connection the request was received on, nil when the request
+// was not received by CoapServer
+func (p *CoapPacket) Session() *Session {
+	return p.session
+}
+
+// ID is unique among sessions of the process
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.sc.conn.RemoteAddr()
+}
+
+// Logger returns logger of the server, with peer address attribute
+func (s *Session) Logger() *slog.Logger {
+	return s.sc.log
+}
+
+// PeerCSM returns capabilities of the client, they may change during the session
+func (s *Session) PeerCSM() Capabilities {
+	s.sc.writeMu.Lock()
+	defer s.sc.writeMu.Unlock()
+
+	return *s.sc.peerCsm
+}
+
+// TLSConnectionState returns state of coaps+tcp or coaps+ws connection,
+// false when the connection is not secured
+func (s *Session) TLSConnectionState() (tls.ConnectionState, bool) {
+	if conn, ok := s.sc.conn.netConn().(*tls.Conn); ok {
+		return conn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// SetAttribute stores a value for the lifetime of the connection, for example
+// identity of the client set by an authentication middleware
+func (s *Session) SetAttribute(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributes[key] = value
+}
+
+func (s *Session) Attribute(key string) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.attributes[key]
+	return value, ok
+}
+
+// Ping checks that the client is alive, it waits for Pong
+func (s *Session) Ping(ctx context.Context) error {
+	_, err := s.InvokeCoapContext(ctx, NewCoapPacket(CODE_702_PING, []byte{}))
+	return err
+}
+
+// Send writes a message without waiting for a response, for example a signal
+// or a notification with a token known to the client
+func (s *Session) Send(packet *CoapPacket) error {
+	return s.sc.write(packet)
+}
+
+// Close closes the connection
+func (s *Session) Close() error {
+	return s.sc.conn.Close()
+}
+
+// Done is closed when the connection is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.sc.closed
+}
+
+func (s *Session) InvokeContext(ctx context.Context, method uint8, uriPath string, contentFormat int16, payload []byte) (*CoapPacket, error) {
+	req := NewCoapPacket(method, payload)
+	req.SetUriPath(uriPath)
+	req.SetContentFormat(contentFormat)
+
+	return s.InvokeCoapContext(ctx, req)
+}
+
+// InvokeCoapContext sends a request to the client and waits for the response with the same token
+func (s *Session) InvokeCoapContext(ctx context.Context, req *CoapPacket) (*CoapPacket, error) {
+	sc := s.sc
+	req.token = writeDynamicUint32(atomic.AddUint32(&sc.lastToken, 1))
+	key := string(req.token)
+	result := make(chan *CoapPacket, 1)
+
+	sc.mu.Lock()
+	sc.pending[key] = result
+	sc.mu.Unlock()
+	defer func() {
+		sc.mu.Lock()
+		delete(sc.pending, key)
+		sc.mu.Unlock()
+	}()
+
+	if err := sc.write(req); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-result:
+		return resp, nil
+	case <-sc.closed:
+		return nil, ErrSessionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// deliver passes response to the request sent with Session, other responses are dropped
+func (sc *serverConn) deliver(resp *CoapPacket) {
+	sc.mu.Lock()
+	result, exists := sc.pending[string(resp.token)]
+	sc.mu.Unlock()
+
+	if exists {
+		select {
+		case result <- resp:
+		default:
+		}
+	}
+}
+
+//------ client ----------
+
+// RemoteAddr returns address of the server on the current connection
+func (client *CoapClient) RemoteAddr() net.Addr {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+
+	return client.conn.RemoteAddr()
+}
+
+// serve answers request sent by the server with Dialer.Handler, without it with 4.04
+func (client *CoapClient) serve(conn packetConn, req *CoapPacket) {
+	var resp *CoapPacket
+	if client.handler != nil {
+		resp = client.handler.Serve(conn.RemoteAddr(), req)
+	} else {
+		resp = req.ResponseCode(CODE_404_NOT_FOUND)
+	}
+
+	if resp != nil {
+		if err := client.writeTo(conn, resp); err != nil {
+			client.log.Warn("response not sent", "code", resp.StringCode(), "err", err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"bufio"
+	"net"
+)
+
+// packetConn carries whole CoAP messages, either length framed over TCP/TLS
+// or one message per WebSocket frame. Writes must be serialized by the caller.
+type packetConn interface {
+	readPacket(maxSize uint32) (*CoapPacket, error)
+	writePacket(packet *CoapPacket, maxSize uint32) error
+	RemoteAddr() net.Addr
+	Close() error
+	//underlying connection, *tls.Conn for TLS
+	netConn() net.Conn
+}
+
+// tcpConn is a reliable transport with length framing, https://tools.ietf.org/html/rfc8323#section-3.2
+type tcpConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newTcpConn(conn net.Conn) *tcpConn {
+	return &tcpConn{conn, bufio.NewReader(conn)}
+}
+
+func (c *tcpConn) netConn() net.Conn {
+	return c.Conn
+}
+
+func (c *tcpConn) readPacket(maxSize uint32) (*CoapPacket, error) {
+	return ReadCoapWithLimit(c.reader, maxSize)
+}
+
+func (c *tcpConn) writePacket(packet *CoapPacket, maxSize uint32) error {
+	return packet.WriteWithLimit(c.Conn, maxSize)
+}
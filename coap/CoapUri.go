@@ -0,0 +1,247 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Request uri is carried in Uri-Host, Uri-Port, Uri-Path and Uri-Query options.
+// https://tools.ietf.org/html/rfc7252#section-6.4
+// https://tools.ietf.org/html/rfc8323#section-8.1
+
+// default ports of schemes, Uri-Port is omitted when it equals the default
+var defaultPorts = map[string]int{
+	"coap":      5683,
+	"coap+tcp":  5683,
+	"coaps":     5684,
+	"coaps+tcp": 5684,
+	"coap+ws":   80,
+	"coaps+ws":  443,
+}
+
+// UriHost returns Uri-Host option, empty when not present
+func (p *CoapPacket) UriHost() string {
+	host, _ := p.StringOption(OPT_URI_HOST)
+	return host
+}
+
+// SetUriHost removes the option when host is empty
+func (p *CoapPacket) SetUriHost(host string) {
+	if host == "" {
+		p.RemoveOption(OPT_URI_HOST)
+		return
+	}
+	p.SetStringOption(OPT_URI_HOST, host)
+}
+
+// UriPort returns Uri-Port option, 0 when not present
+func (p *CoapPacket) UriPort() uint16 {
+	port, _ := p.UintOption(OPT_URI_PORT)
+	return uint16(port)
+}
+
+// SetUriPort removes the option when port is 0
+func (p *CoapPacket) SetUriPort(port uint16) {
+	if port == 0 {
+		p.RemoveOption(OPT_URI_PORT)
+		return
+	}
+	p.SetUintOption(OPT_URI_PORT, uint32(port))
+}
+
+// UriQuery returns arguments of Uri-Query options, for example ["unit=C", "raw"]
+func (p *CoapPacket) UriQuery() []string {
+	return p.StringOptions(OPT_URI_QUERY)
+}
+
+// AddUriQuery adds a "key=value" argument, or "key" when value is empty
+func (p *CoapPacket) AddUriQuery(key string, value string) {
+	if value != "" {
+		key += "=" + value
+	}
+	p.AddStringOption(OPT_URI_QUERY, key)
+}
+
+// Query parses Uri-Query arguments, an argument without "=" has an empty value.
+// Unlike in http, the arguments are not percent-encoded.
+func (p *CoapPacket) Query() url.Values {
+	values := url.Values{}
+	for _, arg := range p.UriQuery() {
+		key, value, _ := strings.Cut(arg, "=")
+		values.Add(key, value)
+	}
+	return values
+}
+
+// SetURL decomposes absolute or relative uri into options, replacing previous Uri-* options.
+// Uri-Host is set when the host is not an IP address and Uri-Port when the port is not
+// the default one of the scheme.
+// https://tools.ietf.org/html/rfc7252#section-6.4
+func (p *CoapPacket) SetURL(u *url.URL) error {
+	p.RemoveOption(OPT_URI_HOST)
+	p.RemoveOption(OPT_URI_PORT)
+	p.RemoveOption(OPT_URI_PATH)
+	p.RemoveOption(OPT_URI_QUERY)
+
+	if host := u.Hostname(); host != "" && net.ParseIP(host) == nil {
+		p.SetUriHost(strings.ToLower(host))
+	}
+	if u.Port() != "" {
+		port, err := strconv.ParseUint(u.Port(), 10, 16)
+		if err != nil {
+			return err
+		}
+		if defaultPort, ok := defaultPorts[u.Scheme]; !ok || int(port) != defaultPort {
+			p.SetUriPort(uint16(port))
+		}
+	}
+
+	if escapedPath := strings.TrimPrefix(u.EscapedPath(), "/"); escapedPath != "" {
+		for _, segment := range strings.Split(escapedPath, "/") {
+			segment, err := url.PathUnescape(segment)
+			if err != nil {
+				return err
+			}
+			p.AddStringOption(OPT_URI_PATH, segment)
+		}
+	}
+
+	if u.RawQuery != "" {
+		for _, arg := range strings.Split(u.RawQuery, "&") {
+			arg, err := url.PathUnescape(arg)
+			if err != nil {
+				return err
+			}
+			p.AddStringOption(OPT_URI_QUERY, arg)
+		}
+	}
+	return nil
+}
+
+// URL composes uri from options, it is relative when the request has no Uri-Host.
+// https://tools.ietf.org/html/rfc7252#section-6.5
+func (p *CoapPacket) URL(scheme string) *url.URL {
+	u := &url.URL{}
+
+	if host := p.UriHost(); host != "" {
+		u.Scheme = scheme
+		u.Host = host
+		if strings.Contains(host, ":") {
+			u.Host = "[" + host + "]"
+		}
+		if port := p.UriPort(); port != 0 {
+			u.Host += ":" + strconv.Itoa(int(port))
+		}
+	}
+
+	return composeURL(u, p.StringOptions(OPT_URI_PATH), p.UriQuery())
+}
+
+// composeURL sets escaped path and query of u, https://tools.ietf.org/html/rfc7252#section-6.5
+func composeURL(u *url.URL, segments []string, args []string) *url.URL {
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		escaped[i] = escapeUriComponent(segment, pathChars)
+	}
+	u.Path = "/" + strings.Join(segments, "/")
+	u.RawPath = "/" + strings.Join(escaped, "/")
+
+	for i, arg := range args {
+		args[i] = escapeUriComponent(arg, queryChars)
+	}
+	u.RawQuery = strings.Join(args, "&")
+
+	return u
+}
+
+// SetLocationPath sets Location-Path options of 2.01 response, for example "/sensors/17"
+// https://tools.ietf.org/html/rfc7252#section-5.10.7
+func (p *CoapPacket) SetLocationPath(path string) {
+	p.RemoveOption(OPT_LOCATION_PATH)
+
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return
+	}
+	for _, segment := range strings.Split(path, "/") {
+		p.AddStringOption(OPT_LOCATION_PATH, segment)
+	}
+}
+
+// AddLocationQuery adds a "key=value" Location-Query argument, or "key" when value is empty
+func (p *CoapPacket) AddLocationQuery(key string, value string) {
+	if value != "" {
+		key += "=" + value
+	}
+	p.AddStringOption(OPT_LOCATION_QUERY, key)
+}
+
+// LocationPath returns all Location-Path options joined into a path, empty when not present
+func (p *CoapPacket) LocationPath() string {
+	var path strings.Builder
+	for _, segment := range p.StringOptions(OPT_LOCATION_PATH) {
+		path.WriteString("/")
+		path.WriteString(segment)
+	}
+	return path.String()
+}
+
+// LocationQuery returns arguments of Location-Query options
+func (p *CoapPacket) LocationQuery() []string {
+	return p.StringOptions(OPT_LOCATION_QUERY)
+}
+
+// Location returns location of created resource as an absolute path reference,
+// nil when the response has no Location-Path or Location-Query option
+func (p *CoapPacket) Location() *url.URL {
+	if !p.HasOption(OPT_LOCATION_PATH) && !p.HasOption(OPT_LOCATION_QUERY) {
+		return nil
+	}
+	return composeURL(&url.URL{}, p.StringOptions(OPT_LOCATION_PATH), p.LocationQuery())
+}
+
+// ResolveLocation returns location of created resource relative to the request uri,
+// for example "coap://localhost/tmp/3" for request "coap://localhost/tmp"
+func (p *CoapPacket) ResolveLocation(requestURL *url.URL) *url.URL {
+	location := p.Location()
+	if location == nil {
+		return nil
+	}
+	return requestURL.ResolveReference(location)
+}
+
+// characters left unescaped besides unreserved ones, https://tools.ietf.org/html/rfc3986#section-3.3
+const (
+	pathChars  = "!$&'()*+,;=:@"
+	queryChars = "!$'()*+,;=:@/?"
+)
+
+func escapeUriComponent(s string, allowed string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.IndexByte("-._~", c) >= 0 || strings.IndexByte(allowed, c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			escaped.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return escaped.String()
+}
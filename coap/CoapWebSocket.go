@@ -0,0 +1,462 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package coap
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// https://tools.ietf.org/html/rfc8323#section-4
+// https://tools.ietf.org/html/rfc6455
+
+const (
+	//well-known WebSocket endpoint, https://tools.ietf.org/html/rfc8323#section-8.3
+	WEBSOCKET_PATH        = "/.well-known/coap"
+	WEBSOCKET_SUBPROTOCOL = "coap"
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	//code and the longest token, enough to answer a message that is too large
+	wsMessageHead = 2 + 8
+)
+
+//------ server ----------
+
+// WebSocketHandler returns http.Handler serving coap+ws connections with the server handlers,
+// it is usually mounted at WEBSOCKET_PATH. Browsers may connect only from pages of the same host,
+// see WebSocketHandlerWithOrigin.
+func (server *CoapServer) WebSocketHandler() http.Handler {
+	return server.WebSocketHandlerWithOrigin(sameOrigin)
+}
+
+// WebSocketHandlerWithOrigin is like WebSocketHandler, checkOrigin decides whether a handshake is
+// accepted, usually by its Origin header. Browsers send Origin of the page opening the connection
+// and do not restrict WebSocket connections to other hosts, so any page the user visits could
+// otherwise use the server. Rejected handshakes get 403.
+func (server *CoapServer) WebSocketHandlerWithOrigin(checkOrigin func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.serveWebSocket(w, r, checkOrigin)
+	})
+}
+
+// sameOrigin accepts handshakes without Origin, sent by clients other than browsers,
+// and from pages of the host the handshake is sent to
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func (server *CoapServer) serveWebSocket(w http.ResponseWriter, r *http.Request, checkOrigin func(r *http.Request) bool) {
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "not a WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	if !headerContains(r.Header, "Sec-WebSocket-Protocol", WEBSOCKET_SUBPROTOCOL) {
+		http.Error(w, "subprotocol coap required", http.StatusBadRequest)
+		return
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can not be upgraded", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		server.log.Warn("WebSocket upgrade failed", "peer", r.RemoteAddr, "err", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + WEBSOCKET_SUBPROTOCOL + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	server.serveConn(&wsConn{Conn: conn, reader: rw.Reader})
+}
+
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func wsAccept(key string) string {
+	hash := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+//------ client ----------
+
+// ConnectWebSocket connects to coap+ws or coaps+ws endpoint, for example "coap+ws://localhost:8080".
+// WEBSOCKET_PATH is used when uri has no path, config is used only by coaps+ws.
+func ConnectWebSocket(uri string, config *tls.Config) (*CoapClient, error) {
+	return (&Dialer{TLSConfig: config}).DialWebSocket(uri)
+}
+
+func ConnectWebSocketWithCSM(uri string, config *tls.Config, csm *Capabilities) (*CoapClient, error) {
+	return (&Dialer{CSM: csm, TLSConfig: config}).DialWebSocket(uri)
+}
+
+// DialWebSocket connects to coap+ws or coaps+ws endpoint, see ConnectWebSocket
+func (d *Dialer) DialWebSocket(uri string) (*CoapClient, error) {
+	return d.connect(uri, func(uri string) (packetConn, error) {
+		conn, err := dialWebSocket(uri, d.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+func dialWebSocket(uri string, config *tls.Config) (*wsConn, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "coap+ws":
+		conn, err = net.Dial("tcp", hostWithPort(u, "80"))
+	case "coaps+ws":
+		conn, err = tls.Dial("tcp", hostWithPort(u, "443"), config)
+	default:
+		return nil, errors.New("coap: unsupported WebSocket scheme " + u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	path := u.RequestURI()
+	if u.Path == "" {
+		path = WEBSOCKET_PATH
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Sec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Protocol: %s\r\n\r\n", path, u.Host, key, WEBSOCKET_SUBPROTOCOL)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, errors.New("coap: WebSocket handshake failed: " + resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) || resp.Header.Get("Sec-WebSocket-Protocol") != WEBSOCKET_SUBPROTOCOL {
+		conn.Close()
+		return nil, errors.New("coap: WebSocket handshake failed: unexpected response headers")
+	}
+
+	return &wsConn{Conn: conn, reader: reader, client: true}, nil
+}
+
+func hostWithPort(u *url.URL, defaultPort string) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	return u.Host
+}
+
+//------ connection ----------
+
+// wsConn carries one CoAP message per binary frame, https://tools.ietf.org/html/rfc8323#section-4.2
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader
+	//client masks sent frames and expects unmasked ones
+	client bool
+
+	//pongs are sent from the reading goroutine
+	writeMu sync.Mutex
+}
+
+type wsFrameHeader struct {
+	fin    bool
+	opcode byte
+	length uint64
+	mask   []byte
+}
+
+func (c *wsConn) netConn() net.Conn {
+	return c.Conn
+}
+
+func (c *wsConn) readPacket(maxSize uint32) (*CoapPacket, error) {
+	var message []byte
+	var size uint64
+	fragmented := false
+
+	for {
+		h, err := c.readFrameHeader()
+		if err != nil {
+			return nil, err
+		}
+
+		//control frames may come between fragments
+		if h.opcode >= wsOpClose {
+			err = c.handleControl(h)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		//text frames are not allowed
+		if h.opcode != wsOpBinary && h.opcode != wsOpContinuation {
+			return nil, &MessageFormatError{fmt.Sprintf("WebSocket frame opcode %d", h.opcode)}
+		}
+		if (h.opcode == wsOpContinuation) != fragmented {
+			return nil, &MessageFormatError{"unexpected WebSocket continuation frame"}
+		}
+		fragmented = !h.fin
+
+		size += h.length
+		tooLarge := maxSize > 0 && size > uint64(maxSize)
+
+		keep := h.length
+		if tooLarge && len(message) >= wsMessageHead {
+			keep = 0
+		} else if tooLarge && keep > uint64(wsMessageHead-len(message)) {
+			keep = uint64(wsMessageHead - len(message))
+		}
+		data := make([]byte, keep)
+		if _, err = io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		if _, err = io.CopyN(io.Discard, c.reader, int64(h.length-keep)); err != nil {
+			return nil, err
+		}
+		unmask(data, h.mask)
+		message = append(message, data...)
+
+		if !h.fin {
+			continue
+		}
+		if tooLarge {
+			if size > 0xFFFFFFFF {
+				size = 0xFFFFFFFF
+			}
+			return wsMessageHeadPacket(message), &MessageTooLargeError{uint32(size), maxSize}
+		}
+		return UnmarshalWebSocket(message)
+	}
+}
+
+func (c *wsConn) readFrameHeader() (*wsFrameHeader, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, buf); err != nil {
+		return nil, err
+	}
+	if buf[0]&0x70 != 0 {
+		return nil, &MessageFormatError{"reserved WebSocket frame bits"}
+	}
+
+	h := &wsFrameHeader{fin: buf[0]&0x80 != 0, opcode: buf[0] & 0x0F, length: uint64(buf[1] & 0x7F)}
+	masked := buf[1]&0x80 != 0
+	if masked == c.client {
+		return nil, &MessageFormatError{"WebSocket frame masking"}
+	}
+
+	switch h.length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return nil, err
+		}
+		h.length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return nil, err
+		}
+		h.length = binary.BigEndian.Uint64(ext)
+		if h.length > 1<<62 {
+			return nil, &MessageFormatError{"WebSocket frame length"}
+		}
+	}
+	if h.opcode >= wsOpClose && (!h.fin || h.length > 125) {
+		return nil, &MessageFormatError{"WebSocket control frame"}
+	}
+
+	if masked {
+		h.mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, h.mask); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (c *wsConn) handleControl(h *wsFrameHeader) error {
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+	unmask(payload, h.mask)
+
+	switch h.opcode {
+	case wsOpPing:
+		return c.writeFrame(wsOpPong, payload)
+	case wsOpClose:
+		c.writeFrame(wsOpClose, payload)
+		return io.EOF
+	}
+	return nil
+}
+
+func (c *wsConn) writePacket(packet *CoapPacket, maxSize uint32) error {
+	data, err := packet.MarshalWebSocket()
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && uint32(len(data)) > maxSize {
+		return &MessageTooLargeError{uint32(len(data)), maxSize}
+	}
+
+	return c.writeFrame(wsOpBinary, data)
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+
+	var frame []byte
+	length := len(payload)
+	if length < 126 {
+		frame = []byte{0x80 | opcode, maskBit | byte(length)}
+	} else if length <= 0xFFFF {
+		frame = []byte{0x80 | opcode, maskBit | 126, 0, 0}
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	} else {
+		frame = []byte{0x80 | opcode, maskBit | 127, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+
+	if c.client {
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		frame = append(frame, mask...)
+
+		masked := append([]byte{}, payload...)
+		unmask(masked, mask)
+		payload = masked
+	}
+
+	_, err := c.Conn.Write(append(frame, payload...))
+	return err
+}
+
+// Close sends close frame with normal closure status and closes the connection
+func (c *wsConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(wsOpClose, []byte{0x03, 0xE8})
+
+	return c.Conn.Close()
+}
+
+func unmask(data []byte, mask []byte) {
+	if mask == nil {
+		return
+	}
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+}
+
+// wsMessageHeadPacket returns code and token of a message that was not read completely
+func wsMessageHeadPacket(head []byte) *CoapPacket {
+	packet := &CoapPacket{token: []byte{}}
+	if len(head) < 2 {
+		return packet
+	}
+
+	packet.Code = head[1]
+	tklLen := int(head[0] & 0x0F)
+	if tklLen <= 8 && len(head) >= 2+tklLen {
+		packet.token = head[2 : 2+tklLen]
+	}
+	return packet
+}
@@ -14,8 +14,25 @@ limitations under the License.
 package coap_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"github.com/szymex/go-coap-tcp/coap"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func Test_ping_pong(t *testing.T) {
@@ -97,6 +114,1160 @@ func Test_getHandlerShouldReturn405OnPost(t *testing.T) {
 	server.Stop()
 }
 
+func Test_concurrentRequests(t *testing.T) {
+
+	server := coap.NewCoapServer()
+	server.HandleFunc("/echo", func(req *coap.CoapPacket) *coap.CoapPacket {
+		return req.Response(coap.CODE_205_CONTENT, coap.MT_TEXT_PLAIN, req.Payload)
+	})
+
+	start(&server, ":55683")
+	client := connectClient(t, "127.0.0.1:55683")
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := fmt.Sprintf("request-%d", i)
+
+			resp, err := client.Post("/echo", payload)
+			if err != nil {
+				t.Error(err)
+			} else if string(resp.Payload) != payload {
+				t.Errorf("\nExpected: %v\n  Actual: %v", payload, string(resp.Payload))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	client.Close()
+	server.Stop()
+}
+
+func Test_requestWithContextTimeout(t *testing.T) {
+
+	server := coap.NewCoapServer()
+	server.HandleGet("/slow", func(req *coap.CoapPacket) *coap.CoapPacket {
+		time.Sleep(200 * time.Millisecond)
+		return req.ResponseText(coap.CODE_205_CONTENT, "slow")
+	})
+	server.HandleGet("/fast", func(req *coap.CoapPacket) *coap.CoapPacket {
+		return req.ResponseText(coap.CODE_205_CONTENT, "fast")
+	})
+
+	start(&server, ":56683")
+	client := connectClient(t, "127.0.0.1:56683")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.GetContext(ctx, "/slow")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Unexpected: %v", err)
+	}
+
+	//late response of /slow must not be returned
+	resp, err := client.Get("/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Payload) != "fast" {
+		t.Fatalf("\nExpected: fast\n  Actual: %v", string(resp.Payload))
+	}
+
+	client.Close()
+	server.Stop()
+}
+
+func Test_observe(t *testing.T) {
+
+	server := coap.NewCoapServer()
+	observers := make(chan *coap.Observer, 1)
+	server.HandleGet("/obs", func(req *coap.CoapPacket) *coap.CoapPacket {
+		if obs := req.AcceptObserve(); obs != nil {
+			observers <- obs
+		}
+		return req.ResponseText(coap.CODE_205_CONTENT, "0")
+	})
+
+	start(&server, ":57683")
+	client := connectClient(t, "127.0.0.1:57683")
+
+	obs, err := client.Observe(context.Background(), "/obs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	observer := <-observers
+
+	for i := 1; i <= 3; i++ {
+		err = observer.Notify(observer.Request().ResponseText(coap.CODE_205_CONTENT, fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lastSeq := int64(-1)
+	for i := 0; i <= 3; i++ {
+		notification := <-obs.Notifications()
+		seq, _ := notification.UintOption(coap.OPT_OBSERVE)
+		if string(notification.Payload) != fmt.Sprint(i) || int64(seq) <= lastSeq {
+			t.Fatalf("Unexpected notification: %v", notification)
+		}
+		lastSeq = int64(seq)
+	}
+
+	if err = obs.Cancel(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-observer.Done()
+	if _, open := <-obs.Notifications(); open {
+		t.Fatal("Notifications should be closed")
+	}
+
+	//connection drop ends observation
+	obs, _ = client.Observe(context.Background(), "/obs")
+	observer = <-observers
+	client.Close()
+	<-observer.Done()
+	for range obs.Notifications() {
+	}
+
+	server.Stop()
+}
+
+func Test_observeNotAccepted(t *testing.T) {
+
+	server := coap.NewCoapServer()
+	server.HandleGet("/test", func(req *coap.CoapPacket) *coap.CoapPacket {
+		return req.ResponseText(coap.CODE_205_CONTENT, "test")
+	})
+
+	start(&server, ":58683")
+	client := connectClient(t, "127.0.0.1:58683")
+
+	obs, err := client.Observe(context.Background(), "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := <-obs.Notifications()
+	if resp.HasOption(coap.OPT_OBSERVE) || string(resp.Payload) != "test" {
+		t.Fatalf("Unexpected: %v", resp)
+	}
+	if _, open := <-obs.Notifications(); open {
+		t.Fatal("Notifications should be closed")
+	}
+
+	client.Close()
+	server.Stop()
+}
+
+func Test_observeNotAcceptable(t *testing.T) {
+
+	observers := make(chan *coap.Observer, 1)
+	server := coap.NewCoapServer()
+	server.HandleGet("/test", func(req *coap.CoapPacket) *coap.CoapPacket {
+		observers <- req.AcceptObserve()
+		return req.ResponseText(coap.CODE_205_CONTENT, "test")
+	})
+	start(&server, ":26683")
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:26683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	coap.NewCoapPacket(coap.CODE_701_CSM, []byte{}).Write(conn)
+	coap.ReadCoap(reader)
+
+	req := coap.NewCoapPacket(coap.GET, []byte{})
+	req.SetUriPath("/test")
+	req.SetAccept(coap.MT_APPLICATION_JSON)
+	req.SetUintOption(coap.OPT_OBSERVE, coap.OBSERVE_REGISTER)
+	req.Write(conn)
+
+	resp, err := coap.ReadCoap(reader)
+	if err != nil || resp.Code != coap.CODE_406_NOT_ACCEPTABLE || resp.HasOption(coap.OPT_OBSERVE) {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+	select {
+	case <-(<-observers).Done():
+	case <-time.After(time.Second):
+		t.Fatal("Observation should end")
+	}
+}
+
+func Test_blockwiseTransfer(t *testing.T) {
+	for _, bert := range []bool{false, true} {
+		server := coap.NewCoapServerWithCSM(&coap.Capabilities{MaxMessageSize: 1500, BlockWiseTransfer: bert})
+		server.HandleFunc("/echo", func(req *coap.CoapPacket) *coap.CoapPacket {
+			return req.Response(coap.CODE_205_CONTENT, coap.MT_APPLICATION_OCTET_STREAM, req.Payload)
+		})
+		start(&server, ":59683")
+
+		client, err := coap.ConnectWithCSM("127.0.0.1:59683", &coap.Capabilities{MaxMessageSize: 3000, BlockWiseTransfer: bert})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payload := make([]byte, 20000)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+
+		//both Block1 and Block2
+		resp, err := client.Invoke(coap.POST, "/echo", coap.MT_APPLICATION_OCTET_STREAM, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != coap.CODE_205_CONTENT || !bytes.Equal(resp.Payload, payload) || resp.HasOption(coap.OPT_BLOCK2) {
+			t.Fatalf("Unexpected: %v", resp)
+		}
+
+		client.Close()
+		server.Stop()
+	}
+}
+
+func Test_blockwiseTransferNearMaxMessageSize(t *testing.T) {
+
+	server := coap.NewCoapServer()
+	server.HandleFunc("/echo", func(req *coap.CoapPacket) *coap.CoapPacket {
+		return req.Response(coap.CODE_205_CONTENT, coap.MT_APPLICATION_OCTET_STREAM, req.Payload)
+	})
+	start(&server, ":28683")
+	defer server.Stop()
+
+	client := connectClient(t, "127.0.0.1:28683")
+	defer client.Close()
+
+	//frames without token just below the limit, the token must not push them over it
+	for size := 9975; size <= 10000; size++ {
+		payload := make([]byte, size)
+		resp, err := client.Invoke(coap.POST, "/echo", coap.MT_APPLICATION_OCTET_STREAM, payload)
+		if err != nil {
+			t.Fatalf("payload %d: %v", size, err)
+		}
+		if resp.Code != coap.CODE_205_CONTENT || !bytes.Equal(resp.Payload, payload) {
+			t.Fatalf("payload %d, unexpected: %v", size, resp)
+		}
+	}
+}
+
+func Test_concurrentBlockwiseTransfers(t *testing.T) {
+
+	server := coap.NewCoapServerWithCSM(&coap.Capabilities{MaxMessageSize: 1500})
+	server.HandleFunc("/big", func(req *coap.CoapPacket) *coap.CoapPacket {
+		return req.ResponseText(coap.CODE_205_CONTENT, strings.Repeat(req.Query().Get("id")+",", 1000))
+	})
+	server.HandleFunc("/echo", func(req *coap.CoapPacket) *coap.CoapPacket {
+		return req.Response(coap.CODE_205_CONTENT, coap.MT_APPLICATION_OCTET_STREAM, req.Payload)
+	})
+	start(&server, ":23683")
+	defer server.Stop()
+
+	client, err := coap.ConnectWithCSM("127.0.0.1:23683", &coap.Capabilities{MaxMessageSize: 1500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+
+		//same path, different query
+		go func(i int) {
+			defer wg.Done()
+			req := coap.NewCoapPacket(coap.GET, []byte{})
+			req.SetUriPath("/big")
+			req.AddUriQuery("id", fmt.Sprint(i))
+			expected := strings.Repeat(fmt.Sprint(i)+",", 1000)
+
+			resp, err := client.InvokeCoapContext(context.Background(), req)
+			if err != nil {
+				t.Error(err)
+			} else if string(resp.Payload) != expected {
+				t.Errorf("id=%d, unexpected: %v", i, resp)
+			}
+		}(i)
+
+		//same request, different payload
+		go func(i int) {
+			defer wg.Done()
+			payload := bytes.Repeat([]byte{byte(i)}, 5000)
+
+			resp, err := client.Invoke(coap.POST, "/echo", coap.MT_APPLICATION_OCTET_STREAM, payload)
+			if err != nil {
+				t.Error(err)
+			} else if resp.Code != coap.CODE_205_CONTENT || !bytes.Equal(resp.Payload, payload) {
+				t.Errorf("payload %d, unexpected: %v", i, resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func Test_badOptionOnFirstBlock(t *testing.T) {
+
+	server := coap.NewCoapServer()
+	server.HandleFunc("/upload", func(req *coap.CoapPacket) *coap.CoapPacket {
+		return req.ResponseCode(coap.CODE_204_CHANGED)
+	})
+	start(&server, ":27683")
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:27683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	coap.NewCoapPacket(coap.CODE_701_CSM, []byte{}).Write(conn)
+	coap.ReadCoap(reader)
+
+	//rejected before the rest of the body is sent
+	req := coap.NewCoapPacket(coap.PUT, make([]byte, 1024))
+	req.SetUriPath("/upload")
+	req.SetBlock1(coap.Block{Num: 0, More: true, SZX: 6})
+	req.AddOption(2049, []byte{})
+	req.Write(conn)
+
+	resp, err := coap.ReadCoap(reader)
+	if err != nil || resp.Code != coap.CODE_402_BAD_OPTION {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+}
+
+func Test_malformedMessageShouldAbort(t *testing.T) {
+
+	server := coap.NewCoapServer()
+	start(&server, ":35683")
+
+	conn, err := net.Dial("tcp", "127.0.0.1:35683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	coap.NewCoapPacket(coap.CODE_701_CSM, []byte{}).Write(conn)
+	coap.ReadCoap(reader)
+
+	//option header with reserved nibble
+	conn.Write([]byte{0x20, coap.GET, 0xF1, 0x00})
+
+	resp, err := coap.ReadCoap(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != coap.CODE_705_ABORT {
+		t.Fatalf("\nExpected: 7.05\n  Actual: %v", resp.StringCode())
+	}
+
+	conn.Close()
+	server.Stop()
+}
+
+func Test_maxMessageSize(t *testing.T) {
+
+	server := coap.NewCoapServerWithCSM(&coap.Capabilities{MaxMessageSize: 100})
+	start(&server, ":45683")
+
+	//client refuses to send, options alone do not fit
+	client := connectClient(t, "127.0.0.1:45683")
+	_, err := client.Post("/"+strings.Repeat("x", 200), "")
+
+	var tooLarge *coap.MessageTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("Unexpected: %v", err)
+	}
+	client.Close()
+
+	//server responds with 4.13
+	conn, _ := net.Dial("tcp", "127.0.0.1:45683")
+	reader := bufio.NewReader(conn)
+	coap.NewCoapPacket(coap.CODE_701_CSM, []byte{}).Write(conn)
+	coap.ReadCoap(reader)
+
+	coap.NewCoapPacket(coap.POST, make([]byte, 200)).Write(conn)
+
+	resp, err := coap.ReadCoap(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size1, _ := resp.UintOption(coap.OPT_SIZE1); resp.Code != coap.CODE_413_REQUEST_ENTITY_TOO_LARGE || size1 != 100 {
+		t.Fatalf("\nExpected: 4.13\n  Actual: %v", resp)
+	}
+
+	conn.Close()
+	server.Stop()
+}
+
+func Test_tls(t *testing.T) {
+	cert, roots := selfSignedCert(t)
+
+	server := coap.NewCoapServer()
+	server.HandleFunc("/test", func(req *coap.CoapPacket) *coap.CoapPacket {
+		if state, ok := req.Session().TLSConnectionState(); !ok || state.NegotiatedProtocol != "coap" {
+			return req.ResponseCode(coap.CODE_403_FORBIDDEN)
+		}
+		return req.Response(coap.CODE_205_CONTENT, -1, []byte("secure"))
+	})
+	ch := make(chan bool)
+	go server.StartTLS(":5684", &tls.Config{Certificates: []tls.Certificate{cert}}, ch)
+	<-ch
+
+	client, err := coap.ConnectTLS("127.0.0.1:5684", &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != coap.CODE_205_CONTENT || string(resp.Payload) != "secure" {
+		t.Fatalf("Unexpected: %v", resp)
+	}
+	client.Close()
+
+	//server negotiates "coap" protocol
+	conn, err := tls.Dial("tcp", "127.0.0.1:5684", &tls.Config{RootCAs: roots, NextProtos: []string{"coap"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != coap.ALPN_COAP {
+		t.Fatalf("\nExpected: coap\n  Actual: %q", proto)
+	}
+	conn.Close()
+
+	//untrusted certificate
+	_, err = coap.ConnectTLS("127.0.0.1:5684", &tls.Config{})
+	if err == nil {
+		t.Fatal("Expected certificate verification error")
+	}
+
+	server.Stop()
+}
+
+func Test_webSocket(t *testing.T) {
+
+	server := coap.NewCoapServer()
+	server.HandleFunc("/test", func(req *coap.CoapPacket) *coap.CoapPacket {
+		return req.Response(coap.CODE_205_CONTENT, -1, req.Payload)
+	})
+	mux := http.NewServeMux()
+	mux.Handle(coap.WEBSOCKET_PATH, server.WebSocketHandler())
+	l, err := net.Listen("tcp", "127.0.0.1:8683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, mux)
+
+	client, err := coap.ConnectWebSocket("coap+ws://127.0.0.1:8683", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	//large payload spans several frames worth of blocks
+	payload := bytes.Repeat([]byte("0123456789"), 3000)
+	resp, err := client.Post("/test", string(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != coap.CODE_205_CONTENT || !bytes.Equal(resp.Payload, payload) {
+		t.Fatalf("Unexpected: %v", resp)
+	}
+	client.Close()
+
+	//subprotocol is required
+	httpResp, err := http.Get("http://127.0.0.1:8683" + coap.WEBSOCKET_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("\nExpected: 400\n  Actual: %v", httpResp.Status)
+	}
+
+	//browser pages of other hosts are rejected
+	for origin, status := range map[string]int{"http://127.0.0.1:8683": http.StatusSwitchingProtocols, "http://evil.example": http.StatusForbidden} {
+		handshake, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:8683"+coap.WEBSOCKET_PATH, nil)
+		handshake.Header.Set("Connection", "Upgrade")
+		handshake.Header.Set("Upgrade", "websocket")
+		handshake.Header.Set("Sec-WebSocket-Version", "13")
+		handshake.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		handshake.Header.Set("Sec-WebSocket-Protocol", coap.WEBSOCKET_SUBPROTOCOL)
+		handshake.Header.Set("Origin", origin)
+		httpResp, err = http.DefaultClient.Do(handshake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpResp.Body.Close()
+		if httpResp.StatusCode != status {
+			t.Fatalf("%s\nExpected: %d\n  Actual: %v", origin, status, httpResp.Status)
+		}
+	}
+
+	l.Close()
+}
+
+func Test_gracefulShutdown(t *testing.T) {
+
+	started := make(chan struct{}, 1)
+	finish := make(chan struct{})
+	server := coap.NewCoapServer()
+	server.HandleFunc("/slow", func(req *coap.CoapPacket) *coap.CoapPacket {
+		started <- struct{}{}
+		<-finish
+		return req.ResponseText(coap.CODE_205_CONTENT, "done")
+	})
+	start(&server, ":9683")
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	coap.NewCoapPacket(coap.CODE_701_CSM, []byte{}).Write(conn)
+	coap.ReadCoap(reader)
+
+	req := coap.NewCoapPacket(coap.GET, []byte{})
+	req.SetUriPath("/slow")
+	req.Write(conn)
+	<-started
+
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- server.ShutdownWithRelease(context.Background(), coap.NewRelease("127.0.0.1:9684", 5*time.Second))
+	}()
+
+	//peer is told to go away, in-flight request is still served
+	release, err := coap.ReadCoap(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holdOff, _ := release.UintOption(coap.OPT_RELEASE_HOLD_OFF); release.Code != coap.CODE_704_RELEASE || holdOff != 5 {
+		t.Fatalf("\nExpected: 7.04\n  Actual: %v", release)
+	}
+	if _, err = net.Dial("tcp", "127.0.0.1:9683"); err == nil {
+		t.Fatal("Expected refused connection")
+	}
+
+	close(finish)
+	resp, err := coap.ReadCoap(reader)
+	if err != nil || resp.Code != coap.CODE_205_CONTENT {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+	if err = <-shutdownErr; err != nil {
+		t.Fatal(err)
+	}
+	if _, err = coap.ReadCoap(reader); err == nil {
+		t.Fatal("Expected closed connection")
+	}
+	conn.Close()
+
+	//in-flight request does not finish in time
+	server2 := coap.NewCoapServer()
+	server2.HandleFunc("/slow", func(req *coap.CoapPacket) *coap.CoapPacket {
+		started <- struct{}{}
+		time.Sleep(time.Second)
+		return req.ResponseText(coap.CODE_205_CONTENT, "done")
+	})
+	start(&server2, ":9683")
+
+	client := connectClient(t, "127.0.0.1:9683")
+	go client.Get("/slow")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = server2.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Unexpected: %v", err)
+	}
+	if _, err = client.Get("/slow"); !errors.Is(err, coap.ErrClientClosed) {
+		t.Fatalf("Unexpected: %v", err)
+	}
+}
+
+func Test_releaseShouldReconnect(t *testing.T) {
+
+	newServer := func(name string, address string) *coap.CoapServer {
+		server := coap.NewCoapServer()
+		server.HandleFunc("/name", func(req *coap.CoapPacket) *coap.CoapPacket {
+			return req.ResponseText(coap.CODE_205_CONTENT, name)
+		})
+		start(&server, address)
+		return &server
+	}
+	first := newServer("first", ":13683")
+	second := newServer("second", ":14683")
+	defer second.Stop()
+
+	client := connectClient(t, "127.0.0.1:13683")
+	defer client.Close()
+
+	if err := first.ShutdownWithRelease(context.Background(), coap.NewRelease("127.0.0.1:14683", time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	//let the client receive release, it waits for hold-off and continues with the alternative server
+	time.Sleep(100 * time.Millisecond)
+	before := time.Now()
+	resp, err := client.Get("/name")
+	if err != nil || string(resp.Payload) != "second" {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+	if time.Since(before) < 500*time.Millisecond {
+		t.Errorf("Expected hold-off, reconnected after %v", time.Since(before))
+	}
+}
+
+func Test_abortShouldDisconnect(t *testing.T) {
+
+	server := coap.NewCoapServer()
+	start(&server, ":16683")
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:16683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	coap.NewCoapPacket(coap.CODE_701_CSM, []byte{}).Write(conn)
+	coap.ReadCoap(reader)
+
+	coap.NewAbort("going away").Write(conn)
+	if _, err = coap.ReadCoap(reader); err == nil {
+		t.Fatal("Expected closed connection")
+	}
+}
+
+func Test_pingWithCustody(t *testing.T) {
+
+	answered := make(chan struct{})
+	server := coap.NewCoapServer()
+	server.HandleFunc("/slow", func(req *coap.CoapPacket) *coap.CoapPacket {
+		time.Sleep(200 * time.Millisecond)
+		return req.ResponseText(coap.CODE_205_CONTENT, "done")
+	})
+	start(&server, ":17683")
+	defer server.Stop()
+
+	client := connectClient(t, "127.0.0.1:17683")
+	defer client.Close()
+
+	started := make(chan struct{})
+	go func() {
+		close(started)
+		client.Get("/slow")
+		close(answered)
+	}()
+	<-started
+	time.Sleep(50 * time.Millisecond)
+
+	if err := client.PingWithCustody(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-answered:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Expected pong after the response")
+	}
+}
+
+func Test_pingWithCustodyShouldNotBlockResponses(t *testing.T) {
+
+	//handler asks the client, its response must be read while the ping waits
+	server := coap.NewCoapServer()
+	server.HandleFunc("/ask", func(req *coap.CoapPacket) *coap.CoapPacket {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		answer, err := req.Session().InvokeContext(ctx, coap.GET, "/device", -1, []byte{})
+		if err != nil {
+			return req.ResponseText(coap.CODE_504_GATEWAY_TIMEOUT, err.Error())
+		}
+		return req.ResponseText(coap.CODE_205_CONTENT, string(answer.Payload))
+	})
+	start(&server, ":24683")
+	defer server.Stop()
+
+	device := coap.HandlerFunc(func(req *coap.CoapPacket) *coap.CoapPacket {
+		time.Sleep(100 * time.Millisecond)
+		return req.ResponseText(coap.CODE_205_CONTENT, "device")
+	})
+	client, err := (&coap.Dialer{Handler: device}).Dial("127.0.0.1:24683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	answered := make(chan *coap.CoapPacket, 1)
+	go func() {
+		resp, _ := client.Get("/ask")
+		answered <- resp
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	before := time.Now()
+	if err := client.PingWithCustody(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(before) > time.Second {
+		t.Errorf("Pong after %v", time.Since(before))
+	}
+	if resp := <-answered; resp == nil || string(resp.Payload) != "device" {
+		t.Fatalf("Unexpected: %v", resp)
+	}
+}
+
+func Test_keepAlive(t *testing.T) {
+
+	//server that never answers ping
+	l, err := net.Listen("tcp", "127.0.0.1:18683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pings := make(chan *coap.CoapPacket, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		coap.ReadCoap(reader)
+		coap.NewCoapPacket(coap.CODE_701_CSM, []byte{}).Write(conn)
+		for {
+			p, err := coap.ReadCoap(reader)
+			if err != nil {
+				return
+			}
+			pings <- p
+		}
+	}()
+
+	dialer := coap.Dialer{KeepAlive: 100 * time.Millisecond, KeepAliveTimeout: 50 * time.Millisecond}
+	client, err := dialer.Dial("127.0.0.1:18683")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ping := <-pings; ping.Code != coap.CODE_702_PING {
+		t.Fatalf("\nExpected: 7.02\n  Actual: %v", ping)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err = client.Ping(); !errors.Is(err, coap.ErrKeepAliveTimeout) {
+		t.Fatalf("Unexpected: %v", err)
+	}
+}
+
+func Test_reconnectShouldReplayRequest(t *testing.T) {
+
+	//first connection fails after receiving a request, the server comes back on the same port
+	l, err := net.Listen("tcp", "127.0.0.1:19683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := coap.NewCoapServer()
+	server.HandleFunc("/name", func(req *coap.CoapPacket) *coap.CoapPacket {
+		return req.ResponseText(coap.CODE_205_CONTENT, "back")
+	})
+	defer server.Stop()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		reader := bufio.NewReader(conn)
+		coap.ReadCoap(reader)
+		coap.NewCoapPacket(coap.CODE_701_CSM, []byte{}).Write(conn)
+		coap.ReadCoap(reader)
+		conn.Close()
+		l.Close()
+
+		start(&server, "127.0.0.1:19683")
+	}()
+
+	states := make(chan coap.ConnState, 10)
+	dialer := coap.Dialer{
+		Reconnect: &coap.ReconnectPolicy{InitialBackoff: 50 * time.Millisecond, ReplayIdempotent: true},
+		OnStateChange: func(state coap.ConnState, err error) {
+			states <- state
+		},
+	}
+	client, err := dialer.Dial("127.0.0.1:19683")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get("/name")
+	if err != nil || string(resp.Payload) != "back" {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+	if state := <-states; state != coap.STATE_RECONNECTING {
+		t.Fatalf("Unexpected: %v", state)
+	}
+	if state := <-states; state != coap.STATE_CONNECTED {
+		t.Fatalf("Unexpected: %v", state)
+	}
+
+	client.Close()
+	if state := <-states; state != coap.STATE_CLOSED {
+		t.Fatalf("Unexpected: %v", state)
+	}
+}
+
+func Test_serverRequest(t *testing.T) {
+
+	server := coap.NewCoapServer()
+	start(&server, ":20683")
+	defer server.Stop()
+
+	//device behind NAT serves commands on its connection
+	commands := coap.NewRouter()
+	commands.HandleMethod(coap.POST, "/cmd", coap.HandlerFunc(func(req *coap.CoapPacket) *coap.CoapPacket {
+		return req.ResponseText(coap.CODE_204_CHANGED, "done "+string(req.Payload))
+	}))
+	client, err := (&coap.Dialer{Handler: commands}).Dial("127.0.0.1:20683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("Unexpected sessions: %v", sessions)
+	}
+
+	resp, err := sessions[0].InvokeContext(context.Background(), coap.POST, "/cmd", coap.MT_TEXT_PLAIN, []byte("reboot"))
+	if err != nil || resp.Code != coap.CODE_204_CHANGED || string(resp.Payload) != "done reboot" {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+	resp, err = sessions[0].InvokeContext(context.Background(), coap.GET, "/other", -1, []byte{})
+	if err != nil || resp.Code != coap.CODE_404_NOT_FOUND {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+
+	//client answers ping of the server
+	if err = sessions[0].Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	//requests in the other direction still work
+	if err = client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_clientShouldAnswerPing(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:30683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pongs := make(chan *coap.CoapPacket, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		coap.ReadCoap(reader)
+		coap.NewCoapPacket(coap.CODE_701_CSM, []byte{}).Write(conn)
+
+		ping := coap.NewCoapPacket(coap.CODE_702_PING, []byte{})
+		ping.AddOption(coap.OPT_PING_CUSTODY, []byte{})
+		ping.Write(conn)
+		pong, _ := coap.ReadCoap(reader)
+		pongs <- pong
+	}()
+
+	client := connectClient(t, "127.0.0.1:30683")
+	defer client.Close()
+
+	select {
+	case pong := <-pongs:
+		if pong == nil || pong.Code != coap.CODE_703_PONG || !pong.HasOption(coap.OPT_PING_CUSTODY) {
+			t.Fatalf("Unexpected: %v", pong)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected pong")
+	}
+}
+
+func Test_sessionInHandler(t *testing.T) {
+
+	server := coap.NewCoapServer()
+	server.HandleFunc("/login", func(req *coap.CoapPacket) *coap.CoapPacket {
+		req.Session().SetAttribute("user", string(req.Payload))
+		return req.ResponseCode(coap.CODE_204_CHANGED)
+	})
+	server.HandleFunc("/whoami", func(req *coap.CoapPacket) *coap.CoapPacket {
+		session := req.Session()
+		user, _ := session.Attribute("user")
+		_, secure := session.TLSConnectionState()
+		return req.ResponseText(coap.CODE_205_CONTENT, fmt.Sprint(user, " ", secure, " ", session.PeerCSM().MaxMessageSize))
+	})
+	start(&server, ":21683")
+	defer server.Stop()
+
+	client := connectClient(t, "127.0.0.1:21683")
+	defer client.Close()
+	other, err := coap.ConnectWithCSM("127.0.0.1:21683", &coap.Capabilities{MaxMessageSize: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if _, err = client.Post("/login", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	//attributes belong to the connection
+	resp, err := client.Get("/whoami")
+	if err != nil || string(resp.Payload) != "alice false 10000" {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+	resp, err = other.Get("/whoami")
+	if err != nil || string(resp.Payload) != "<nil> false 2000" {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+}
+
+func Test_conditionalRequests(t *testing.T) {
+
+	var mu sync.Mutex
+	value, version := "first", byte(1)
+	server := coap.NewCoapServer()
+	state := func(req *coap.CoapPacket) ([]byte, bool) {
+		return []byte{version}, true
+	}
+	server.Handle("/res", coap.Conditional(coap.HandlerFunc(func(req *coap.CoapPacket) *coap.CoapPacket {
+		if req.Code == coap.PUT {
+			value = string(req.Payload)
+			version++
+		}
+		resp := req.ResponseText(coap.CODE_205_CONTENT, value)
+		resp.SetETag([]byte{version})
+		return resp
+	}), &mu, state))
+	start(&server, ":22683")
+	defer server.Stop()
+
+	client := connectClient(t, "127.0.0.1:22683")
+	defer client.Close()
+
+	cached, err := client.Get("/res")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//server answers 2.03 without payload, the cached representation is still valid
+	resp, err := client.Revalidate(context.Background(), "/res", cached)
+	if err != nil || resp.Code != coap.CODE_205_CONTENT || string(resp.Payload) != "first" {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+	req := coap.NewCoapPacket(coap.GET, []byte{})
+	req.SetUriPath("/res")
+	req.AddETag([]byte{1})
+	if resp, err = client.InvokeCoap(req); err != nil || resp.Code != coap.CODE_203_VALID || len(resp.Payload) != 0 {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+
+	//update conditional on the cached version, the second one is lost
+	for i, code := range []uint8{coap.CODE_205_CONTENT, coap.CODE_412_PRECONDITION_FAILED} {
+		req = coap.NewCoapPacket(coap.PUT, []byte(fmt.Sprint("update ", i)))
+		req.SetUriPath("/res")
+		req.AddIfMatch([]byte{1})
+		if resp, err = client.InvokeCoap(req); err != nil || resp.Code != code {
+			t.Fatalf("Unexpected: %v, %v", resp, err)
+		}
+	}
+
+	//create only when missing
+	req = coap.NewCoapPacket(coap.PUT, []byte("create"))
+	req.SetUriPath("/res")
+	req.SetIfNoneMatch(true)
+	if resp, err = client.InvokeCoap(req); err != nil || resp.Code != coap.CODE_412_PRECONDITION_FAILED {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+
+	resp, err = client.Revalidate(context.Background(), "/res", cached)
+	if err != nil || string(resp.Payload) != "update 0" {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+}
+
+func Test_concurrentHandling(t *testing.T) {
+
+	for _, limit := range []int{2, 1} {
+		release := make(chan struct{})
+		server := coap.NewCoapServer()
+		server.SetMaxConcurrentRequests(limit)
+		server.HandleFunc("/slow", func(req *coap.CoapPacket) *coap.CoapPacket {
+			<-release
+			return req.ResponseText(coap.CODE_205_CONTENT, "slow")
+		})
+		server.HandleFunc("/fast", func(req *coap.CoapPacket) *coap.CoapPacket {
+			return req.ResponseText(coap.CODE_205_CONTENT, "fast")
+		})
+		start(&server, ":10683")
+
+		client := connectClient(t, "127.0.0.1:10683")
+		slow := make(chan *coap.CoapPacket)
+		go func() {
+			resp, _ := client.Get("/slow")
+			slow <- resp
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		//fast request overtakes the slow one only when the limit allows
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		resp, err := client.GetContext(ctx, "/fast")
+		cancel()
+		if limit > 1 && (err != nil || string(resp.Payload) != "fast") {
+			t.Fatalf("Unexpected: %v, %v", resp, err)
+		}
+		if limit == 1 && !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Unexpected: %v, %v", resp, err)
+		}
+
+		close(release)
+		if resp = <-slow; resp == nil || string(resp.Payload) != "slow" {
+			t.Fatalf("Unexpected: %v", resp)
+		}
+
+		client.Close()
+		server.Stop()
+	}
+}
+
+func Test_concurrencyLimitShouldNotBlockResponses(t *testing.T) {
+
+	//handler waits for the client answer while another request waits for the handler
+	server := coap.NewCoapServer()
+	server.SetMaxConcurrentRequests(1)
+	server.HandleFunc("/ask", func(req *coap.CoapPacket) *coap.CoapPacket {
+		time.Sleep(50 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		answer, err := req.Session().InvokeContext(ctx, coap.GET, "/device", -1, []byte{})
+		if err != nil {
+			return req.ResponseText(coap.CODE_504_GATEWAY_TIMEOUT, err.Error())
+		}
+		return req.ResponseText(coap.CODE_205_CONTENT, string(answer.Payload))
+	})
+	start(&server, ":29683")
+	defer server.Stop()
+
+	device := coap.HandlerFunc(func(req *coap.CoapPacket) *coap.CoapPacket {
+		return req.ResponseText(coap.CODE_205_CONTENT, "device")
+	})
+	client, err := (&coap.Dialer{Handler: device}).Dial("127.0.0.1:29683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get("/ask")
+			if err != nil || string(resp.Payload) != "device" {
+				t.Errorf("Unexpected: %v, %v", resp, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err = client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+func Test_logger(t *testing.T) {
+
+	logs := &lockedBuffer{}
+	server := coap.NewCoapServer()
+	server.SetLogger(slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelError})))
+	server.Use(coap.Recovery)
+	server.HandleFunc("/panic", func(req *coap.CoapPacket) *coap.CoapPacket {
+		panic("handler failure")
+	})
+	start(&server, ":12683")
+
+	dialer := coap.Dialer{Logger: slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	client, err := dialer.Dial("127.0.0.1:12683")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Get("/test")
+	if resp, err := client.Get("/panic"); err != nil || resp.Code != coap.CODE_500_INTERNAL_SERVER_ERROR {
+		t.Fatalf("Unexpected: %v, %v", resp, err)
+	}
+	client.Close()
+	server.Stop()
+
+	for _, expected := range []string{"msg=\"handler panic\" peer=127.0.0.1:", "panic=\"handler failure\"", "msg=connected peer=127.0.0.1:12683", "msg=sent peer=127.0.0.1:12683 code=GET token=", "msg=received peer=127.0.0.1:12683 code=4.04"} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("\nExpected: %s\n  Actual: %s", expected, logs.String())
+		}
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
 func start(server *coap.CoapServer, address string) {
 	ch := make(chan bool)
 	go server.Start(address, ch)
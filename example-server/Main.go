@@ -14,18 +14,29 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
 	"github.com/szymex/go-coap-tcp/coap"
+	"log/slog"
 	"math/rand"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
 	"time"
 )
 
 func main() {
 	server := coap.NewCoapServer()
+	server.SetLogger(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	server.Use(coap.Recovery)
 	server.HandleGet("/time", func(req *coap.CoapPacket) *coap.CoapPacket {
-		t := time.Now().In(time.UTC)
-		return req.ResponseText(coap.CODE_205_CONTENT, t.Format("2006-01-02 15:04:05 -0700 MST"))
+		if obs := req.AcceptObserve(); obs != nil {
+			go notifyTime(obs)
+		}
+		return currentTime(req)
 	})
 
 	server.Handle("/my-ip", MyIpHandler{})
@@ -34,7 +45,8 @@ func main() {
 		return req.ResponseText(coap.CODE_205_CONTENT, rfc8323)
 	})
 
-	server.Handle("/tmp", &ReadWriteResourceHandler{})
+	tmp := &ReadWriteResourceHandler{exists: true}
+	server.Handle("/tmp", coap.Conditional(tmp, &tmp.mu, tmp.state))
 
 	server.HandleGet("/slow", func(req *coap.CoapPacket) *coap.CoapPacket {
 		wait := time.Duration(rand.Intn(9)) + 1
@@ -42,7 +54,51 @@ func main() {
 		return req.ResponseText(coap.CODE_205_CONTENT, fmt.Sprintf("Waited %d seconds", wait))
 	})
 
-	panic(server.Start(":5683", nil))
+	//coap+ws://localhost:8080
+	go func() {
+		panic(http.ListenAndServe(":8080", server.WebSocketHandler()))
+	}()
+
+	//release clients and wait for slow requests on Ctrl+C
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		<-interrupt
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	if err := server.Start(":5683", nil); err != coap.ErrServerClosed {
+		panic(err)
+	}
+}
+
+// currentTime is in UTC or in time zone from query, for example /time?tz=Europe/Warsaw
+func currentTime(req *coap.CoapPacket) *coap.CoapPacket {
+	location, err := time.LoadLocation(req.Query().Get("tz"))
+	if err != nil {
+		return req.ResponseText(coap.CODE_400_BAD_REQUEST, "unknown time zone")
+	}
+	t := time.Now().In(location)
+	return req.ResponseText(coap.CODE_205_CONTENT, t.Format("2006-01-02 15:04:05 -0700 MST"))
+}
+
+func notifyTime(obs *coap.Observer) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-obs.Done():
+			return
+		case <-ticker.C:
+			if obs.Notify(currentTime(obs.Request())) != nil {
+				return
+			}
+		}
+	}
 }
 
 type MyIpHandler struct {
@@ -55,9 +111,14 @@ func (f MyIpHandler) Serve(addr net.Addr, req *coap.CoapPacket) *coap.CoapPacket
 }
 
 type ReadWriteResourceHandler struct {
+	//requests are served concurrently, coap.Conditional holds it while serving
+	mu            sync.Mutex
+	exists        bool
 	payload       []byte
 	contentFormat int16
 	maxAge        uint32
+	//changes with every update, clients use it in If-Match to avoid lost updates
+	version uint32
 }
 
 func (f *ReadWriteResourceHandler) Serve(addr net.Addr, req *coap.CoapPacket) *coap.CoapPacket {
@@ -65,24 +126,45 @@ func (f *ReadWriteResourceHandler) Serve(addr net.Addr, req *coap.CoapPacket) *c
 
 	switch req.Code {
 	case coap.GET:
+		if !f.exists {
+			return req.ResponseCode(coap.CODE_404_NOT_FOUND)
+		}
 		resp.Payload = f.payload
-		resp.ContentFormat = f.contentFormat
-		resp.MaxAge = f.maxAge
+		resp.SetContentFormat(f.contentFormat)
+		resp.SetMaxAge(f.maxAge)
 
-	case coap.PUT | coap.POST:
-		f.maxAge = req.MaxAge
-		f.contentFormat = req.ContentFormat
+	case coap.PUT, coap.POST:
+		f.maxAge = req.MaxAge()
+		f.contentFormat = req.ContentFormat()
 		f.payload = req.Payload
+		f.version++
 		resp.Code = coap.CODE_204_CHANGED
+		if !f.exists {
+			resp.Code = coap.CODE_201_CREATED
+		}
+		f.exists = true
 
 	case coap.DELETE:
+		f.exists = false
 		f.maxAge = 60
 		f.contentFormat = -1
 		f.payload = []byte{}
+		f.version++
 		resp.Code = coap.CODE_202_DELETED
+		return resp
 	default:
 		resp.Code = coap.CODE_500_INTERNAL_SERVER_ERROR
 	}
 
+	resp.SetETag(f.etag())
 	return resp
 }
+
+func (f *ReadWriteResourceHandler) etag() []byte {
+	return binary.BigEndian.AppendUint32(nil, f.version)
+}
+
+// state is used by coap.Conditional to evaluate If-Match and If-None-Match
+func (f *ReadWriteResourceHandler) state(req *coap.CoapPacket) ([]byte, bool) {
+	return f.etag(), f.exists
+}